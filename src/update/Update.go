@@ -5,366 +5,1013 @@ package main
 Author Bartosz Wołcerz
  */
 import (
-	"./scp"
+	"./changelog"
+	"./config"
+	"./pipeline"
+	"./plan"
+	"./progress"
+	"./redact"
+	"./process"
 	"./sshConnection"
+	"./transfer"
+	"context"
+	"errors"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 	"os/exec"
 	"bytes"
+	"bufio"
 	"io"
 	"flag"
+	"log"
 	"strings"
+	"net/url"
+	"io/ioutil"
+	"unicode/utf16"
 )
 
-func getProjectDir(giturl string) string {
-	return giturl[strings.LastIndex(giturl, "/")+1:]
-}
 func getEarRelativePath(srcRoot string) string {
 	return "/" + srcRoot + "-ear/target/" + srcRoot + "-ear.ear"
 }
+
+// dryRun collects the planned actions instead of executing them in -plan mode.
+var dryRun *plan.Plan
+
+// status prints a progress message of the helpers, left out in -plan mode.
+func status(a ...interface{}) {
+	if dryRun == nil {
+		fmt.Println(a...)
+	}
+}
+
+// commandTimeout limits every local and remote command, zero means no limit.
+var commandTimeout time.Duration
+
 func main() {
-	parameters := parseArg()
-	prepareFileNames(parameters)
-	liquibaseCMD := createLiquibaseCmd(parameters)
-
-	localDbLogFileBackup(parameters)
-
-	client := sshConnection.GetClient(parameters)
-	runRemoteCmd(&client, remoteDbLogTableDump, parameters)
-
-	copyFromRemote(&client, getValue(parameters, "remote-db-log-file-path"))
-	dropLocalDbLogTable(parameters)
-	localDbLogTableRestore(parameters, getLocalTmpDir(parameters)+getValue(parameters, "remote-db-log-file-path"))
-	localPullProject(parameters)
-
-	projectWorkingDir := getValue(parameters, "local-project-dir") + getProjectDir(getValue(parameters, "repo-url"))
-
-	getDbChangesSql(projectWorkingDir, liquibaseCMD)
-	dropLocalDbLogTable(parameters)
-	localDbLogTableRestore(parameters, getLocalTmpDir(parameters)+getValue(parameters, "local-db-log-file-path"))
-	buildEAR(projectWorkingDir)
-
-	deploymentDir := "deploy_v" + parameters["version"] + "_" + getValue(parameters, "file-timestamp")
-	prepareDeploymentPackage(projectWorkingDir,
-		getLocalTmpDir(parameters)+deploymentDir,
-		getLocalTmpDir(parameters)+getValue(parameters, "sql-file"),
-		getValue(parameters, "src-root"))
-	copyToRemote(&client, getLocalTmpDir(parameters), deploymentDir+".tar.gz")
-	clean([]string{
-		getLocalTmpDir(parameters) + deploymentDir + ".tar.gz",
-		getLocalTmpDir(parameters) + getValue(parameters, "sql-file"),
-		getLocalTmpDir(parameters) + getValue(parameters, "local-db-log-file-path"),
-		getLocalTmpDir(parameters) + getValue(parameters, "remote-db-log-file-path"),
-	})
+	cfg := parseArg()
+	prepareFileNames(cfg)
+	if err := cfg.ResolveSecrets(); err != nil {
+		redact.Println(err.Error())
+		os.Exit(2)
+	}
+	redact.Add(cfg.Secrets()...)
+	log.SetOutput(redact.Writer{W: os.Stderr})
+	commandTimeout = cfg.Timeouts.CommandTimeout()
+
+	runID := cfg.Files.Timestamp
+	stateFile := pipeline.StateFile(cfg.LocalTmpDir(), runID)
+
+	remote := &remoteClient{cfg: cfg}
+	registry := createSteps(cfg, remote)
+	names := splitList(cfg.Steps)
+	skip := splitList(cfg.SkipSteps)
+	var state *pipeline.State
+	if cfg.Resume != "" {
+		var err error
+		state, err = pipeline.LoadState(stateFile)
+		if err != nil {
+			redact.Println(err.Error())
+			os.Exit(2)
+		}
+		if len(names) == 0 {
+			names, skip = state.Steps, nil
+		}
+	}
+	if len(names) == 0 {
+		names = registry.Names()
+	}
+	addCustomSteps(registry, remote, names)
+	deployment, err := registry.Build(names, skip)
+	if err != nil {
+		redact.Println(err.Error())
+		os.Exit(2)
+	}
+	if err := cfg.Validate(pending(deployment, state)); err != nil {
+		redact.Println(err.Error())
+		if !cfg.Plan {
+			os.Exit(2)
+		}
+	}
+	if cfg.Plan {
+		dryRun = plan.New()
+	}
+	if dryRun != nil {
+		printPlan(deployment, state)
+		return
+	}
+	if state == nil {
+		state = pipeline.NewState(stateFile, runID, deployment.Names())
+	}
+	deployment.State = state
+	deployment.Check = remote.checkArtifacts
+	deployment.Timeout = cfg.Timeouts.StepTimeout()
+	deployment.Timeouts = cfg.Timeouts.StepTimeouts()
+	fmt.Println("Run id: " + runID + " (resume with -resume=" + runID + ")")
+	ctx, closeEvents, err := progressContext(interruptContext(), cfg)
+	if err != nil {
+		redact.Println(err.Error())
+		os.Exit(2)
+	}
+	err = deployment.Run(ctx)
+	remote.close()
+	closeEvents()
+	if err != nil {
+		if ctx.Err() != nil {
+			fmt.Println("Run cancelled, resume with -resume=" + runID)
+		}
+		os.Exit(1)
+	}
 }
 
-func remoteDbLogDump(parameters map[string]string) sshConnection.Command {
-	remoteDb := parameters["remote-db-name"]
-	remoteDbUser := parameters["remote-db-user"]
-	dbLogFileDump := getRemoteTmpDir() + parameters["remote-db-log-file-path"]
-	dbPass := parameters["remote-db-pass"]
-	dbUrl := getValue(parameters, "remote-db-url")
-	dbPort := getValue(parameters, "remote-db-port")
-	schema := getValue(parameters, "remote-db-schema")
-	cmd := "pg_dump -U " + remoteDbUser + " -d " + remoteDb + " -h " + dbUrl + " -p " + dbPort + " -t " + schema + ".databasechangelog -O -x -f " + dbLogFileDump
-	if len(dbPass) > 0 {
-		cmd = "export PGPASSWORD='" + dbPass + "';" + cmd
+// pending returns the steps of the run not finished by a resumed one.
+func pending(deployment *pipeline.Pipeline, state *pipeline.State) []string {
+	steps := []string{}
+	for _, name := range deployment.Names() {
+		if state == nil || !state.IsFinished(name) {
+			steps = append(steps, name)
+		}
 	}
-	return sshConnection.Command{Cmd: cmd}
+	return steps
+}
+
+// interruptContext is cancelled on the first Ctrl+C or SIGTERM, so the running
+// commands are killed and the completed steps undone. A second signal kills
+// the local commands still running (they have their own process groups and
+// do not get the signal of the terminal) and stops the program at once.
+func interruptContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		fmt.Println("Received " + sig.String() + ", cancelling the run (repeat to abort at once)")
+		cancel()
+		sig = <-signals
+		fmt.Println("Received " + sig.String() + " again, aborting")
+		process.KillAll()
+		os.Exit(1)
+	}()
+	return ctx
+}
+
+// progressContext shows the progress of transfers on the console and appends
+// it to the -progress-events file, the transfers share the bandwidth limit.
+func progressContext(ctx context.Context, cfg *config.Config) (context.Context, func(), error) {
+	sinks := progress.Sinks{progress.Console{W: redact.Writer{W: os.Stdout}}}
+	closeEvents := func() {}
+	if cfg.ProgressEvents != "" {
+		f, err := os.OpenFile(cfg.ProgressEvents, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot open progress events file: %w", err)
+		}
+		sinks = append(sinks, progress.NewJSON(redact.Writer{W: f}))
+		closeEvents = func() { f.Close() }
+	}
+	return progress.With(ctx, sinks, progress.NewLimiter(cfg.Remote.BandwidthBytes())), closeEvents, nil
+}
+
+// createSteps registers the default deployment flow. The registration order is
+// the order used when -steps is not given.
+func createSteps(cfg *config.Config, remote *remoteClient) *pipeline.Registry {
+	liquibaseCMD := createLiquibaseCmd(cfg)
+	projectWorkingDir := cfg.ProjectDir()
+	deploymentDir := "deploy_v" + cfg.Version + "_" + cfg.Files.Timestamp
+	localLogFile := cfg.LocalTmpDir() + cfg.Files.LocalDbLogFile
+	remoteLogFile := cfg.LocalTmpDir() + cfg.Files.RemoteDbLogFile
+	sqlFile := cfg.LocalTmpDir() + cfg.Files.SqlFile
+	restoreLocalLog := func(ctx context.Context) error {
+		return localDbLogTableRestore(ctx, cfg, localLogFile)
+	}
+
+	r := pipeline.NewRegistry()
+	r.Add(pipeline.WithArtifacts(pipeline.NewStep("local-changelog-backup", func(ctx context.Context) error {
+		return localDbLogFileBackup(ctx, cfg)
+	}, nil), localLogFile))
+	r.Add(pipeline.WithRemoteArtifacts(pipeline.NewStep("remote-changelog-dump", func(ctx context.Context) error {
+		return runRemoteCmd(ctx, remote, remoteDbLogTableDump(cfg))
+	}, nil), getRemoteTmpDir()+cfg.Files.RemoteDbLogFile))
+	r.Add(pipeline.WithArtifacts(pipeline.NewStep("remote-changelog-fetch", func(ctx context.Context) error {
+		return copyFromRemote(ctx, remote, cfg, cfg.Files.RemoteDbLogFile)
+	}, func(ctx context.Context) error {
+		removeDirectory(remoteLogFile)
+		return nil
+	}), remoteLogFile))
+	r.Add(pipeline.NewStep("remote-changelog-restore", func(ctx context.Context) error {
+		return localDbLogTableRestore(ctx, cfg, remoteLogFile)
+	}, restoreLocalLog))
+	r.Add(pipeline.WithArtifacts(pipeline.NewStep("pull-project", func(ctx context.Context) error {
+		return localPullProject(ctx, cfg)
+	}, func(ctx context.Context) error {
+		removeDirectory(cfg.LocalTmpDir() + cfg.Files.LocalProjectDir)
+		return nil
+	}), projectWorkingDir))
+	r.Add(pipeline.WithArtifacts(pipeline.NewStep("sql-diff", func(ctx context.Context) error {
+		return getDbChangesSql(ctx, cfg, projectWorkingDir, liquibaseCMD)
+	}, func(ctx context.Context) error {
+		removeDirectory(sqlFile)
+		return nil
+	}), sqlFile))
+	r.Add(pipeline.NewStep("local-changelog-restore", restoreLocalLog, nil))
+	r.Add(pipeline.WithArtifacts(pipeline.NewStep("build-ear", func(ctx context.Context) error {
+		return buildEAR(ctx, projectWorkingDir)
+	}, nil), projectWorkingDir+getEarRelativePath(cfg.Liquibase.SrcRoot)))
+	r.Add(pipeline.WithArtifacts(pipeline.NewStep("package", func(ctx context.Context) error {
+		return prepareDeploymentPackage(ctx, projectWorkingDir,
+			cfg.LocalTmpDir()+deploymentDir,
+			sqlFile,
+			cfg.Liquibase.SrcRoot)
+	}, func(ctx context.Context) error {
+		clean([]string{
+			cfg.LocalTmpDir() + deploymentDir,
+		})
+		return nil
+	}), cfg.LocalTmpDir()+deploymentDir))
+	r.Add(pipeline.WithRemoteArtifacts(pipeline.NewStep("upload", func(ctx context.Context) error {
+		return copyDirToRemote(ctx, remote, cfg.LocalTmpDir(), deploymentDir)
+	}, nil), getRemoteTmpDir()+deploymentDir))
+	r.Add(pipeline.NewStep("clean", func(ctx context.Context) error {
+		clean([]string{
+			cfg.LocalTmpDir() + deploymentDir,
+			sqlFile,
+			localLogFile,
+			remoteLogFile,
+		})
+		return nil
+	}, nil))
+	return r
+}
+
+// addCustomSteps registers ad hoc steps named "local:<command>" or
+// "remote:<command>", e.g. a smoke test run after the upload. They cannot be
+// undone, so a finished one is not repeated by -resume.
+func addCustomSteps(r *pipeline.Registry, remote *remoteClient, names []string) {
+	for _, name := range names {
+		name := name
+		switch {
+		case strings.HasPrefix(name, "local:"):
+			r.Add(pipeline.Permanent(pipeline.NewStep(name, func(ctx context.Context) error {
+				cmd := exec.Command("sh", "-c", strings.TrimPrefix(name, "local:"))
+				return showCommandOutput(ctx, cmd)
+			}, nil)))
+		case strings.HasPrefix(name, "remote:"):
+			r.Add(pipeline.Permanent(pipeline.NewStep(name, func(ctx context.Context) error {
+				return runRemoteCmd(ctx, remote, func(conn sshConnection.ConnectionInt) []func() error {
+					return []func() error{
+						func() error {
+							conn.Execute(sshConnection.Command{Cmd: strings.TrimPrefix(name, "remote:")})
+							return conn.Valid()
+						},
+					}
+				})
+			}, nil)))
+		}
+	}
+}
+
+// printPlan walks the pipeline with dryRun set and prints what it would do.
+// The helpers skip their progress messages while walking.
+func printPlan(deployment *pipeline.Pipeline, state *pipeline.State) {
+	for _, s := range deployment.Steps {
+		if state != nil && state.IsFinished(s.Name()) {
+			continue
+		}
+		dryRun.Step(s.Name())
+		if err := s.Run(context.Background()); err != nil {
+			dryRun.File("step would fail: " + err.Error())
+		}
+	}
+	dryRun.Print(redact.Writer{W: os.Stdout})
+}
+
+// remoteClient creates the ssh client on first use, so the key is only read
+// when a step needs the remote host. All steps share its connection. In
+// -plan mode the client only carries the address.
+type remoteClient struct {
+	cfg      *config.Config
+	client   *sshConnection.Client
+	transfer transfer.Transferer
 }
 
-func remoteDbLogTableDump(conn sshConnection.ConnectionInt, parameters map[string]string) []func() {
-	wildflyPass := getValue(parameters, "wildfly-pass")
-	valid := func() {
-		conn.Valid()
+func (r *remoteClient) get() (*sshConnection.Client, error) {
+	if r.client == nil {
+		if dryRun != nil {
+			r.client = &sshConnection.Client{Host: r.cfg.Remote.Address()}
+		} else {
+			conf, err := connectionConfiguration(r.cfg)
+			if err != nil {
+				return nil, err
+			}
+			c, err := sshConnection.GetSSHConnectionConfig(&conf)
+			if err != nil {
+				return nil, err
+			}
+			c.CommandTimeout = commandTimeout
+			c.KeepAliveInterval = r.cfg.Remote.KeepAliveInterval()
+			c.KeepAliveCountMax = r.cfg.Remote.KeepAliveCountMax
+			c.ReconnectAttempts = r.cfg.Remote.ReconnectAttempts
+			r.client = c
+		}
 	}
-	loginAsWildfly := func() {
-		conn.Execute(sshConnection.Command{Cmd: "su - wildfly"})
-		conn.Execute(sshConnection.Command{Cmd: wildflyPass})
+	return r.client, nil
+}
+
+// transferer returns the file transfer of the configured protocol over the
+// shared connection.
+func (r *remoteClient) transferer() (transfer.Transferer, error) {
+	if r.transfer == nil {
+		c, err := r.get()
+		if err != nil {
+			return nil, err
+		}
+		if r.transfer, err = transfer.New(r.cfg.Remote.Transfer, c, r.cfg.Remote.UploadPerm()); err != nil {
+			return nil, err
+		}
 	}
-	dumpLog := func() {
-		conn.Execute(remoteDbLogDump(parameters))
+	return r.transfer, nil
+}
+
+// checkArtifacts verifies on resume that the files recorded for a finished
+// step are still there and match their digests, remote ones over the shared
+// connection.
+func (r *remoteClient) checkArtifacts(ctx context.Context, f pipeline.StepState) error {
+	if !f.Remote {
+		for _, file := range f.Artifacts {
+			if _, err := os.Stat(file); err != nil {
+				return err
+			}
+		}
+		for file, sum := range f.Digests {
+			got, err := transfer.FileSHA256(file)
+			if err != nil {
+				return err
+			}
+			if got != sum {
+				return fmt.Errorf("%s changed, sha256 %s instead of %s", file, got, sum)
+			}
+		}
+		return nil
 	}
-	chmod := func() {
-		conn.Execute(sshConnection.Command{Cmd: "chmod 777 " + getRemoteTmpDir() + parameters["remote-db-log-file-path"]})
+	files, err := r.transferer()
+	if err != nil {
+		return err
 	}
-	exit := func() {
-		conn.Execute(sshConnection.Command{Cmd: "exit"})
+	for _, file := range f.Artifacts {
+		if _, err := files.Stat(ctx, file); err != nil {
+			return err
+		}
 	}
-	return []func(){
-		loginAsWildfly, valid, dumpLog, valid, chmod, valid, exit, exit,
+	for file, sum := range f.Digests {
+		got, err := files.Checksum(ctx, file)
+		if err != nil {
+			return err
+		}
+		if got != sum {
+			return fmt.Errorf("%s changed on the remote host, sha256 %s instead of %s", file, got, sum)
+		}
+	}
+	return nil
+}
+
+// close closes the shared connection if a step opened it.
+func (r *remoteClient) close() {
+	if r.client != nil {
+		r.client.Close()
+	}
+}
+
+func connectionConfiguration(cfg *config.Config) (sshConnection.ConnectionConfiguration, error) {
+	jumps, err := jumpConfigurations(cfg)
+	if err != nil {
+		return sshConnection.ConnectionConfiguration{}, err
 	}
+	return sshConnection.ConnectionConfiguration{
+		User:            cfg.Remote.User,
+		Password:        cfg.Remote.Password,
+		Remote:          cfg.Remote.UseKey,
+		AddressWithPort: cfg.Remote.Address(),
+		Auth: sshConnection.AuthConfig{
+			Methods:       cfg.Remote.AuthMethods,
+			IdentityFiles: cfg.Remote.IdentityFiles,
+			KeyPassphrase: cfg.Remote.KeyPassphrase,
+		},
+		HostKey: sshConnection.HostKeyConfig{
+			Mode:           cfg.Remote.HostKeyMode,
+			KnownHostsFile: cfg.Remote.KnownHosts,
+			Fingerprint:    cfg.Remote.HostKeyFingerprint,
+		},
+		Jumps: jumps,
+	}, nil
 }
 
-func localDbLogFileBackup(parameters map[string]string) {
-	fmt.Println("local db table backup ...")
-	dumpFile := getLocalTmpDir(parameters) + getValue(parameters, "local-db-log-file-path")
-	user := getValue(parameters, "local-db-user")
-	password := getValue(parameters, "local-db-password")
-	dbName := getValue(parameters, "local-db-name")
-	schema := getValue(parameters, "local-db-schema")
-	if len(password) > 0 {
-		exec.Command("export PGPASSWORD='" + password + "';").Run()
+// jumpConfigurations returns the jump hosts of the remote host, either the
+// configured jump-hosts with their own auth, or the ProxyJump hosts using the
+// auth of the remote host and their ~/.ssh/config entries.
+func jumpConfigurations(cfg *config.Config) ([]sshConnection.ConnectionConfiguration, error) {
+	hostKey := func(fingerprint string) sshConnection.HostKeyConfig {
+		mode := cfg.Remote.HostKeyMode
+		if mode == sshConnection.HostKeyFingerprint && fingerprint == "" {
+			mode = sshConnection.HostKeyKnownHosts
+		}
+		return sshConnection.HostKeyConfig{Mode: mode, KnownHostsFile: cfg.Remote.KnownHosts, Fingerprint: fingerprint}
 	}
-	cmdC := exec.Command("pg_dump", "-U", user, "-d", dbName, "-t", schema+".databasechangelog", "-O", "-x", "-F", "p", "-f", dumpFile)
-	err := cmdC.Run()
+	var jumps []sshConnection.ConnectionConfiguration
+	if len(cfg.Remote.JumpHosts) > 0 {
+		for _, jump := range cfg.Remote.JumpHosts {
+			user, port := jump.User, jump.Port
+			if user == "" {
+				user = cfg.Remote.User
+			}
+			if port == "" {
+				port = "22"
+			}
+			jumps = append(jumps, sshConnection.ConnectionConfiguration{
+				User:            user,
+				Password:        jump.Password,
+				Remote:          cfg.Remote.UseKey,
+				AddressWithPort: jump.Addr + ":" + port,
+				Auth: sshConnection.AuthConfig{
+					Methods:       jump.AuthMethods,
+					IdentityFiles: jump.IdentityFiles,
+					KeyPassphrase: jump.KeyPassphrase,
+				},
+				HostKey: hostKey(jump.HostKeyFingerprint),
+			})
+		}
+		return jumps, nil
+	}
+	specs, err := sshConnection.ParseProxyJump(cfg.Remote.ProxyJump)
 	if err != nil {
-		fmt.Println("Local table not found")
+		return nil, fmt.Errorf("invalid proxy jump: %w", err)
+	}
+	for _, spec := range specs {
+		host := sshConnection.HostConfig{}
+		if cfg.Remote.SSHConfig != "none" {
+			host, err = sshConnection.LookupSSHConfig(cfg.Remote.SSHConfig, spec.Host)
+			if err != nil {
+				return nil, err
+			}
+		}
+		addr, port, user := firstOf(host.HostName, spec.Host), firstOf(spec.Port, host.Port, "22"), firstOf(spec.User, host.User, cfg.Remote.User)
+		remote := cfg.Remote
+		remote.ProxyJump, remote.JumpHosts = "", nil
+		conf, err := connectionConfiguration(&config.Config{Remote: remote})
+		if err != nil {
+			return nil, err
+		}
+		conf.User, conf.AddressWithPort = user, addr+":"+port
+		if len(host.IdentityFiles) > 0 && len(cfg.Remote.IdentityFiles) == 0 {
+			conf.Auth.IdentityFiles = host.IdentityFiles
+		}
+		conf.HostKey = hostKey("")
+		jumps = append(jumps, conf)
+	}
+	return jumps, nil
+}
+
+func firstOf(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
 	}
-	fmt.Println("local db table backup completed")
+	return ""
 }
-func showCommandOutput(cmd *exec.Cmd) {
+
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// remoteDbLogDump dumps the remote changelog table. The password is read from
+// stdin rather than put on the command line, where ps and the logs show it.
+func remoteDbLogDump(cfg *config.Config) sshConnection.Command {
+	db := cfg.RemoteDB
+	dbLogFileDump := getRemoteTmpDir() + cfg.Files.RemoteDbLogFile
+	q := sshConnection.ShellQuote
+	cmd := "pg_dump -U " + q(db.User) + " -d " + q(db.Name) + " -h " + q(db.URL) + " -p " + q(db.Port) +
+		" -t " + q(db.Schema+".databasechangelog") + " -O -x -f " + q(dbLogFileDump)
+	if len(db.Password) > 0 {
+		return sshConnection.Command{Cmd: "IFS= read -r PGPASSWORD && export PGPASSWORD && " + cmd, Stdin: db.Password + "\n"}
+	}
+	return sshConnection.Command{Cmd: cmd}
+}
+
+func remoteDbLogTableDump(cfg *config.Config) func(conn sshConnection.ConnectionInt) []func() error {
+	return func(conn sshConnection.ConnectionInt) []func() error {
+		asWildfly := func(cmd sshConnection.Command) sshConnection.Command {
+			if cfg.Remote.RunAsUser != "" {
+				cmd.RunAs = &sshConnection.RunAs{
+					User:     cfg.Remote.RunAsUser,
+					Method:   cfg.Remote.RunAsMethod,
+					Password: cfg.Remote.WildflyPassword,
+				}
+			}
+			return cmd
+		}
+		dumpLog := func() error {
+			conn.Execute(asWildfly(remoteDbLogDump(cfg)))
+			return conn.Valid()
+		}
+		chmod := func() error {
+			conn.Execute(asWildfly(sshConnection.Command{Cmd: "chmod 777 " + sshConnection.ShellQuote(getRemoteTmpDir()+cfg.Files.RemoteDbLogFile)}))
+			return conn.Valid()
+		}
+		return []func() error{
+			dumpLog, chmod,
+		}
+	}
+}
+
+func localDbLogFileBackup(ctx context.Context, cfg *config.Config) error {
+	status("local db table backup ...")
+	dumpFile := cfg.LocalTmpDir() + cfg.Files.LocalDbLogFile
+	db := cfg.LocalDB
+	if dryRun != nil {
+		dryRun.Database(db.Name, "snapshot "+db.Schema+"."+changelog.Table+" to "+dumpFile)
+		return nil
+	}
+	store, err := localChangelog(cfg)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	err = store.Snapshot(ctx, dumpFile)
+	if errors.Is(err, changelog.ErrNotFound) {
+		status("Local table not found")
+	} else if err != nil {
+		return fmt.Errorf("cannot back up local log table: %w", err)
+	}
+	status("local db table backup completed")
+	return nil
+}
+// localChangelog opens the changelog table of the local database.
+func localChangelog(cfg *config.Config) (*changelog.Store, error) {
+	db := cfg.LocalDB
+	return changelog.Open(changelog.Connection{
+		Host:     db.URL,
+		Port:     db.Port,
+		User:     db.User,
+		Password: db.Password,
+		Name:     db.Name,
+		Schema:   db.Schema,
+		SSLMode:  db.SSLMode,
+	})
+}
+// runCommand runs a local command, or only records it in -plan mode. The
+// command is killed when ctx is done or commandTimeout passes.
+func runCommand(ctx context.Context, cmd *exec.Cmd) error {
+	if dryRun != nil {
+		dryRun.Local(cmd)
+		return nil
+	}
+	return process.Run(ctx, cmd, commandTimeout)
+}
+func makeDir(dir string) error {
+	if dryRun != nil {
+		dryRun.File("mkdir -p " + dir)
+		return nil
+	}
+	return os.MkdirAll(dir, 0777)
+}
+// showCommandOutput runs a local command and prints its output. A failure
+// is returned with the standard error of the command.
+func showCommandOutput(ctx context.Context, cmd *exec.Cmd) error {
+	if dryRun != nil {
+		dryRun.Local(cmd)
+		return nil
+	}
 	var out bytes.Buffer
 	var stderr bytes.Buffer
 	cmd.Stdout = &out
 	cmd.Stderr = &stderr
-	err := cmd.Run()
+	err := process.Run(ctx, cmd, commandTimeout)
 
 	if err != nil {
 		//fmt.Println(out)
-		fmt.Println(fmt.Sprint(err) + " :" + stderr.String())
-		panic("Cannot execute command" + err.Error())
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("%s failed: %w: %s", cmd.Args[0], err, msg)
+		}
+		return fmt.Errorf("%s failed: %w", cmd.Args[0], err)
 	}
 	output := strings.Trim(out.String(), " ")
 	if len(output) > 0 {
-		fmt.Println(out.String())
-	}
-}
-func localDbLogTableRestore(parameters map[string]string, file string) {
-	fmt.Println("restoring table...")
-	user := getValue(parameters, "local-db-user")
-	password := getValue(parameters, "local-db-password")
-	dbName := getValue(parameters, "local-db-name")
-	dbUrl := getValue(parameters, "local-db-url")
-	dbPort := getValue(parameters, "local-db-port")
-	if len(password) > 0 {
-		exec.Command("export PGPASSWORD='" + password + "';").Run()
-	}
-	fmt.Println(file)
-	fmt.Println("restoring table...")
-	exec.Command("psql", "-U", user, "-d", dbName, "-h", dbUrl, "-p", dbPort, "-1", "-f", file).Run()
-	fmt.Println("restoring table completed")
-}
-func dropLocalDbLogTable(parameters map[string]string) {
-	fmt.Println("drop table log file...")
-	dbSchema := getValue(parameters, "local-db-schema")
-	psqlCmd := "drop table " + dbSchema + ".databasechangelog"
-	user := getValue(parameters, "local-db-user")
-	password := getValue(parameters, "local-db-password")
-	dbName := getValue(parameters, "local-db-name")
-	dbUrl := getValue(parameters, "local-db-url")
-	dbPort := getValue(parameters, "local-db-port")
-	if len(password) > 0 {
-		exec.Command("export PGPASSWORD='" + password + "';").Run()
-	}
-	cmd := exec.Command("psql", "-U", user, "-d", dbName, "-h", dbUrl, "-p", dbPort, "-c", psqlCmd)
-	err := cmd.Run()
+		redact.Println(out.String())
+	}
+	return nil
+}
+// localDbLogTableRestore replaces the local log table by the dump in file in
+// one transaction. Without the file, the table did not exist when the dump
+// was taken and is dropped.
+func localDbLogTableRestore(ctx context.Context, cfg *config.Config, file string) error {
+	status("restoring table...")
+	if _, err := os.Stat(file); os.IsNotExist(err) && dryRun == nil {
+		status("Nothing to restore, " + file + " not found")
+		return dropLocalDbLogTable(ctx, cfg)
+	}
+	db := cfg.LocalDB
+	if dryRun != nil {
+		dryRun.Database(db.Name, "replace "+db.Schema+"."+changelog.Table+" by "+file)
+		return nil
+	}
+	status(file)
+	store, err := localChangelog(cfg)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	if err := store.Restore(ctx, file); err != nil {
+		return fmt.Errorf("cannot restore local log table: %w", err)
+	}
+	status("restoring table completed")
+	return nil
+}
+func dropLocalDbLogTable(ctx context.Context, cfg *config.Config) error {
+	status("drop table log file...")
+	store, err := localChangelog(cfg)
 	if err != nil {
-		fmt.Println("Cannot drop local log table." + err.Error())
+		return err
 	}
-	fmt.Println("drop table log file completed")
+	defer store.Close()
+	if err := store.Drop(ctx); err != nil {
+		return fmt.Errorf("cannot drop local log table: %w", err)
+	}
+	status("drop table log file completed")
+	return nil
 }
 
-func localPullProject(parameters map[string]string) {
-	fmt.Println("Downloading project...")
-	dir := parameters["local-project-dir"]
-	err := os.MkdirAll(dir, 0777)
-	userName := parameters["git-login"]
-	password := parameters["git-password"]
-	url := parameters["repo-url"]
-	branch := parameters["git-branch"]
+func localPullProject(ctx context.Context, cfg *config.Config) error {
+	status("Downloading project...")
+	dir := cfg.LocalTmpDir() + cfg.Files.LocalProjectDir
+	err := makeDir(dir)
+	git := cfg.Git
 
 	if err != nil {
-		panic("Cannot create directory." + err.Error())
+		return fmt.Errorf("cannot create directory: %w", err)
 	}
-	repo := fmt.Sprintf("https://%s:%s@%s", userName, password, url)
-	cmd := exec.Command("git", "clone", repo)
+	// The password goes to git through the environment and a credential
+	// helper, so it shows neither in the process list nor in .git/config.
+	repo := "https://" + url.User(git.User).String() + "@" + git.RepoURL
+	cmd := exec.Command("git",
+		"-c", "credential.helper=",
+		"-c", `credential.helper=!f() { test "$1" = get && echo "password=$DEPLOY_GIT_PASSWORD"; }; f`,
+		"clone", repo)
 	cmd.Dir = dir
-	showCommandOutput(cmd)
-	fmt.Println("Downloading project completed")
-	cmd = exec.Command("git", "checkout", "-b", branch, "origin/"+branch)
-	cmd.Dir = dir + "/" + getProjectDir(url) + "/"
-	showCommandOutput(cmd)
-	fmt.Println("Switch branch completed")
-}
-func getDbChangesSql(projectDir string, cmdArgs []string) {
-	fmt.Println("Generating sql diff file...")
+	cmd.Env = append(os.Environ(), "DEPLOY_GIT_PASSWORD="+git.Password, "GIT_TERMINAL_PROMPT=0")
+	if err := showCommandOutput(ctx, cmd); err != nil {
+		return err
+	}
+	status("Downloading project completed")
+	cmd = exec.Command("git", "checkout", "-b", git.Branch, "origin/"+git.Branch)
+	cmd.Dir = cfg.ProjectDir() + "/"
+	if err := showCommandOutput(ctx, cmd); err != nil {
+		return err
+	}
+	status("Switch branch completed")
+	return nil
+}
+func getDbChangesSql(ctx context.Context, cfg *config.Config, projectDir string, cmdArgs []string) error {
+	status("Generating sql diff file...")
+	defaults := cfg.LocalTmpDir() + cfg.Files.LiquibaseDefaults
+	if dryRun != nil {
+		dryRun.File("write local db password to " + defaults)
+	} else {
+		if err := writeLiquibaseDefaults(defaults, cfg.LocalDB.Password); err != nil {
+			return fmt.Errorf("cannot write liquibase defaults: %w", err)
+		}
+		defer os.Remove(defaults)
+	}
 	cmd := exec.Command("java", cmdArgs...)
 	cmd.Dir = projectDir
 	//cmd.Run()
-	showCommandOutput(cmd)
-	fmt.Println("Generating sql diff file completed")
-}
-func saveFile(input *scp.File, localFile string) error {
-	f, err := os.Create(localFile)
-
-	defer func() {
-		if err := f.Close(); err != nil {
-			panic(err)
-		}
-	}()
-	buf := make([]byte, 1024)
-	for {
-		// read a chunk
-		n, err := input.Read(buf)
-		if err != nil && err != io.EOF {
-			panic(err)
-		}
-		if n == 0 {
-			break
-		}
-
-		// write a chunk
-		if _, err := f.Write(buf[:n]); err != nil {
-			panic(err)
-		}
+	if err := showCommandOutput(ctx, cmd); err != nil {
+		return err
 	}
-	return err
+	status("Generating sql diff file completed")
+	return nil
 }
-func buildEAR(projectDir string) {
-	fmt.Println("Building ear...")
+func buildEAR(ctx context.Context, projectDir string) error {
+	status("Building ear...")
 	cmd := exec.Command("mvn", "clean", "install")
 	cmd.Dir = projectDir
-	cmd.Run()
-	fmt.Println("Building ear completed")
+	if err := runCommand(ctx, cmd); err != nil {
+		return fmt.Errorf("mvn clean install failed: %w", err)
+	}
+	status("Building ear completed")
+	return nil
 }
-func prepareDeploymentPackage(projectDir, deploymentDir, sqlFile, srcRoot string) {
-	fmt.Println("Moving files...")
-	err := os.MkdirAll(deploymentDir, 0777)
+func prepareDeploymentPackage(ctx context.Context, projectDir, deploymentDir, sqlFile, srcRoot string) error {
+	status("Moving files...")
+	err := makeDir(deploymentDir)
 	if err != nil {
-		panic("Directory not created" + err.Error())
+		return fmt.Errorf("directory not created: %w", err)
 	}
 	cmd := exec.Command("cp", projectDir+getEarRelativePath(srcRoot), deploymentDir+"/")
 	//cmd.Run()
-	showCommandOutput(cmd)
+	if err := showCommandOutput(ctx, cmd); err != nil {
+		return err
+	}
 	cmd = exec.Command("cp", sqlFile, deploymentDir+"/")
-	showCommandOutput(cmd)
-	fmt.Println("Created package:" + deploymentDir)
-	fmt.Println("Creating archive...")
-	archiveFileName := deploymentDir + ".tar.gz"
-	err = exec.Command("tar", "-czvf", archiveFileName, deploymentDir).Run()
-	if err != nil {
-		fmt.Println("Failed")
-	} else {
-		fmt.Println("Creating archive completed")
-		fmt.Println("Created archive:" + archiveFileName)
+	if err := showCommandOutput(ctx, cmd); err != nil {
+		return err
 	}
+	status("Created package:" + deploymentDir)
+	return nil
 }
 func removeDirectory(dir string) {
+	if dryRun != nil {
+		dryRun.File("rm -rf " + dir)
+		return
+	}
 	err := os.RemoveAll(dir)
 	if err != nil {
-		fmt.Println("Removing directory failed" + err.Error())
+		redact.Println("Removing directory failed" + err.Error())
 	}
 }
-func parseArg() map[string]string {
-	ver := flag.String("version", "no-ver", "deployment version")
-	dir := flag.String("dir", "", "Override default store path")
+func parseArg() *config.Config {
+	cfg := config.Default()
+	flag.StringVar(&cfg.Version, "version", cfg.Version, "deployment version")
+	flag.StringVar(&cfg.Dir, "dir", cfg.Dir, "Override default store path")
 	//remote conf
-	remoteAddress := flag.String("remote-addr", "127.0.0.1", "remote host ip")
-	remotePort := flag.String("remote-port", "22", "remote host port")
-	remoteDbName := flag.String("remote-db-name", "remoteDBName", "Remote db name")
-	remoteDbSchema := flag.String("remote-db-schema", "remoteDBScehma", "Remote db schema")
-	remoteDbUser := flag.String("remote-db-user", "remoteDBUser", "Remote db userName")
-	remoteDbPassword := flag.String("remote-db-pass", "", "Remote db password")
-	remoteDbUrl := flag.String("remote-db-url", "localhost", "Remote db url")
-	remoteDbPort := flag.String("remote-db-port", "5432", "Remote db port")
-	remoteUserName := flag.String("remote-host-user", "wildfly", "Remote user to login")
-	remoteUserPassword := flag.String("remote-host-user-password", "", "Remote user password")
-	wildflyPassword := flag.String("remote-host-wildfly-password", "", "Remote user - wildfly password")
+	flag.StringVar(&cfg.Remote.Addr, "remote-addr", cfg.Remote.Addr, "remote host ip")
+	flag.StringVar(&cfg.Remote.Port, "remote-port", cfg.Remote.Port, "remote host port")
+	flag.StringVar(&cfg.RemoteDB.Name, "remote-db-name", cfg.RemoteDB.Name, "Remote db name")
+	flag.StringVar(&cfg.RemoteDB.Schema, "remote-db-schema", cfg.RemoteDB.Schema, "Remote db schema")
+	flag.StringVar(&cfg.RemoteDB.User, "remote-db-user", cfg.RemoteDB.User, "Remote db userName")
+	flag.StringVar(&cfg.RemoteDB.Password, "remote-db-pass", cfg.RemoteDB.Password, "Remote db password")
+	flag.StringVar(&cfg.RemoteDB.URL, "remote-db-url", cfg.RemoteDB.URL, "Remote db url")
+	flag.StringVar(&cfg.RemoteDB.Port, "remote-db-port", cfg.RemoteDB.Port, "Remote db port")
+	flag.StringVar(&cfg.Remote.User, "remote-host-user", cfg.Remote.User, "Remote user to login")
+	flag.StringVar(&cfg.Remote.Password, "remote-host-user-password", cfg.Remote.Password, "Remote user password")
+	flag.StringVar(&cfg.Remote.WildflyPassword, "remote-host-wildfly-password", cfg.Remote.WildflyPassword, "Remote user - wildfly password")
+	flag.StringVar(&cfg.Remote.RunAsUser, "run-as-user", cfg.Remote.RunAsUser, "Remote user running the database dump, empty to use the login user")
+	flag.StringVar(&cfg.Remote.RunAsMethod, "run-as-method", cfg.Remote.RunAsMethod, "How to become -run-as-user: su, sudo or sudo-password")
 	//local conf
-	localDbUser := flag.String("local-db-user", "username", "Local db username")
-	localDbPassword := flag.String("local-db-password", "", "Local db password")
-	localDbName := flag.String("local-db-name", "localDbName", "Local db name")
-	localDbSchema := flag.String("local-db-schema", "localDbSchema", "Local db schema name")
+	flag.StringVar(&cfg.LocalDB.User, "local-db-user", cfg.LocalDB.User, "Local db username")
+	flag.StringVar(&cfg.LocalDB.Password, "local-db-password", cfg.LocalDB.Password, "Local db password")
+	flag.StringVar(&cfg.LocalDB.Name, "local-db-name", cfg.LocalDB.Name, "Local db name")
+	flag.StringVar(&cfg.LocalDB.Schema, "local-db-schema", cfg.LocalDB.Schema, "Local db schema name")
 	//git conf
-	repoUrl := flag.String("repo-url", "git.name.pl/name1/name2", "Repository url without https")
-	gitBranch := flag.String("git-branch", "master", "Git branch")
-	gitLogin := flag.String("git-user", "username", "Git username")
-	gitPassword := flag.String("git-pass", "", "Git password")
+	flag.StringVar(&cfg.Git.RepoURL, "repo-url", cfg.Git.RepoURL, "Repository url without https")
+	flag.StringVar(&cfg.Git.Branch, "git-branch", cfg.Git.Branch, "Git branch")
+	flag.StringVar(&cfg.Git.User, "git-user", cfg.Git.User, "Git username")
+	flag.StringVar(&cfg.Git.Password, "git-pass", cfg.Git.Password, "Git password")
 	//liquibase conf
-	liquibaseJarPath := flag.String("liquibase-path", "D:/liquibase/liquibase.jar", "Path to liquibase")
-	dbDriverJar := flag.String("db-driver", "D:/liquibase/postgresql-42.1.4.jar", "Path to db driver")
-	localDbUrl := flag.String("local-db-url", "localhost", "Local db url")
-	localDbPort := flag.String("local-db-port", "5432", "Local db port")
-	context := flag.String("sql-context", "prod", "Liquibase context")
-	srcRoot := flag.String("src-root", "directoryName", "Source code root dir")
+	flag.StringVar(&cfg.Liquibase.Path, "liquibase-path", cfg.Liquibase.Path, "Path to liquibase")
+	flag.StringVar(&cfg.Liquibase.DriverJar, "db-driver", cfg.Liquibase.DriverJar, "Path to db driver")
+	flag.StringVar(&cfg.LocalDB.URL, "local-db-url", cfg.LocalDB.URL, "Local db url")
+	flag.StringVar(&cfg.LocalDB.Port, "local-db-port", cfg.LocalDB.Port, "Local db port")
+	flag.StringVar(&cfg.LocalDB.SSLMode, "local-db-sslmode", cfg.LocalDB.SSLMode, "Local db ssl mode: disable, require, verify-ca or verify-full")
+	flag.StringVar(&cfg.Liquibase.Context, "sql-context", cfg.Liquibase.Context, "Liquibase context")
+	flag.StringVar(&cfg.Liquibase.SrcRoot, "src-root", cfg.Liquibase.SrcRoot, "Source code root dir")
 
-	usekey := flag.String("use-key", "true", "Use ssh key?")
+	flag.BoolVar(&cfg.Remote.UseKey, "use-key", cfg.Remote.UseKey, "Use ssh key?")
+	flag.Var((*listValue)(&cfg.Remote.AuthMethods), "auth-methods", "Comma separated ssh auth methods in order: agent,key,password,keyboard-interactive")
+	flag.Var((*listValue)(&cfg.Remote.IdentityFiles), "identity-files", "Comma separated private key files, default ~/.ssh/id_ed25519,id_ecdsa,id_rsa")
+	flag.StringVar(&cfg.Remote.KeyPassphrase, "key-passphrase", cfg.Remote.KeyPassphrase, "Passphrase of encrypted private keys")
+	flag.StringVar(&cfg.Remote.SSHConfig, "ssh-config", cfg.Remote.SSHConfig, "OpenSSH client config used for -remote-addr host aliases, none to disable")
+	flag.StringVar(&cfg.Remote.ProxyJump, "proxy-jump", cfg.Remote.ProxyJump, "Comma separated jump hosts [user@]host[:port] to reach the remote host through")
+	flag.StringVar(&cfg.Remote.KeepAlive, "keepalive", cfg.Remote.KeepAlive, "Interval of ssh keepalive requests, 0 to disable")
+	flag.IntVar(&cfg.Remote.KeepAliveCountMax, "keepalive-count-max", cfg.Remote.KeepAliveCountMax, "Unanswered keepalives after which the connection is dropped")
+	flag.IntVar(&cfg.Remote.ReconnectAttempts, "reconnect-attempts", cfg.Remote.ReconnectAttempts, "How often a dropped connection is restored and a transfer repeated")
+	flag.StringVar(&cfg.Remote.Transfer, "transfer", cfg.Remote.Transfer, "File transfer protocol: auto, sftp or scp")
+	flag.StringVar(&cfg.Remote.BandwidthLimit, "bandwidth-limit", cfg.Remote.BandwidthLimit, "Bytes per second for file transfers, e.g. 512K or 10M, empty for no limit")
+	flag.StringVar(&cfg.ProgressEvents, "progress-events", cfg.ProgressEvents, "File to append the transfer progress to as JSON lines")
+	flag.BoolVar(&cfg.Remote.ResumeUploads, "resume-uploads", cfg.Remote.ResumeUploads, "Continue interrupted uploads from the partial remote file")
+	flag.StringVar(&cfg.Remote.UploadMode, "upload-mode", cfg.Remote.UploadMode, "Octal permissions of uploaded files, e.g. 0640, empty keeps the local ones")
+	flag.StringVar(&cfg.Remote.HostKeyMode, "host-key-mode", cfg.Remote.HostKeyMode, "Host key verification: known-hosts, fingerprint, tofu or insecure")
+	flag.StringVar(&cfg.Remote.KnownHosts, "known-hosts", cfg.Remote.KnownHosts, "known_hosts file, default ~/.ssh/known_hosts")
+	flag.StringVar(&cfg.Remote.HostKeyFingerprint, "host-key-fingerprint", cfg.Remote.HostKeyFingerprint, "Pinned SHA256 fingerprint of the remote host key")
+	//pipeline conf
+	flag.StringVar(&cfg.Steps, "steps", cfg.Steps, "Comma separated steps to run, default all. local:<cmd> and remote:<cmd> add custom steps")
+	flag.StringVar(&cfg.SkipSteps, "skip-steps", cfg.SkipSteps, "Comma separated steps to skip")
+	flag.StringVar(&cfg.Resume, "resume", cfg.Resume, "Run id of an interrupted run to continue")
+	flag.BoolVar(&cfg.Plan, "plan", cfg.Plan, "Print every command of the run without executing it")
+	flag.StringVar(&cfg.Timeouts.Step, "step-timeout", cfg.Timeouts.Step, "Time limit of every step, e.g. 10m")
+	flag.Var((*mapValue)(&cfg.Timeouts.Steps), "step-timeouts", "Comma separated per step time limits, e.g. build-ear=30m,upload=1h")
+	flag.StringVar(&cfg.Timeouts.Command, "command-timeout", cfg.Timeouts.Command, "Time limit of every local and remote command, e.g. 5m")
+	//config file
+	configFile := flag.String("config", "", "YAML configuration file, flags override its values")
+	profile := flag.String("profile", "", "Profile of the configuration file to use")
+	//secrets
+	flag.StringVar(&cfg.Keystore, "keystore", cfg.Keystore, "Encrypted keystore file for keystore:NAME secrets")
+	flag.StringVar(&cfg.KeystorePassphrase, "keystore-passphrase", cfg.KeystorePassphrase, "Keystore passphrase reference (env:, file: or cmd:)")
+	keystorePut := flag.String("keystore-put", "", "Store the value read from stdin as this keystore entry and exit")
 
 	flag.Parse()
 
-	return map[string]string{
-		"version":                   *ver,
-		"dir":                       *dir,
-		"git-login":                 *gitLogin,
-		"git-password":              *gitPassword,
-		"repo-url":                  *repoUrl,
-		"remote-addr":               *remoteAddress,
-		"remote-port":               *remotePort,
-		"remote-db-pass":            *remoteDbPassword,
-		"remote-host-user":          *remoteUserName,
-		"remote-host-user-password": *remoteUserPassword,
-		"wildfly-pass":              *wildflyPassword,
-		"remote-db-name":            *remoteDbName,
-		"remote-db-schema":          *remoteDbSchema,
-		"remote-db-user":            *remoteDbUser,
-		"remote-db-url":             *remoteDbUrl,
-		"remote-db-port":            *remoteDbPort,
-
-		"local-db-user":     *localDbUser,
-		"local-db-password": *localDbPassword,
-		"local-db-name":     *localDbName,
-		"local-db-schema":   *localDbSchema,
-		"liquibase-path":    *liquibaseJarPath,
-		"db-driver-jar":     *dbDriverJar,
-		"local-db-url":      *localDbUrl,
-		"local-db-port":     *localDbPort,
-		"sql-context":       *context,
-		"use-key":           *usekey,
-		"src-root":          *srcRoot,
-
-		"git-branch": *gitBranch,
-	}
-}
-func runRemoteCmd(client *sshConnection.Client,
-	cmds func(con sshConnection.ConnectionInt, params map[string]string) []func(),
-	params map[string]string) {
-	fmt.Println("Remote command...")
-	err := client.Connect()
+	if *configFile == "" && *profile != "" {
+		fmt.Println("-profile requires -config")
+		os.Exit(2)
+	}
+	explicit := map[string]string{}
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = f.Value.String()
+	})
+	loadConfigFile(cfg, *configFile, *profile, explicit)
+	applySSHConfig(cfg, *configFile, *profile, explicit)
+	if *keystorePut != "" {
+		putKeystoreEntry(cfg, *keystorePut)
+		os.Exit(0)
+	}
+	return cfg
+}
+
+// putKeystoreEntry stores the first line of stdin in the keystore.
+func putKeystoreEntry(cfg *config.Config, name string) {
+	ks, err := cfg.OpenKeystore()
 	if err != nil {
-		panic("Session not started" + err.Error())
+		redact.Println(err.Error())
+		os.Exit(2)
 	}
-	client.RunCommands(cmds, params)
-	client.Close()
-	fmt.Println("Remote command completed")
+	value, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		redact.Println("Cannot read value: " + err.Error())
+		os.Exit(2)
+	}
+	ks.Set(name, strings.TrimRight(value, "\r\n"))
+	if err := ks.Save(); err != nil {
+		redact.Println(err.Error())
+		os.Exit(2)
+	}
+	fmt.Println("Keystore entry " + name + " saved")
+}
+
+// listValue is a comma separated list flag.
+type listValue []string
+
+func (l *listValue) String() string {
+	return strings.Join(*l, ",")
 }
-func copyFromRemote(client *sshConnection.Client, remoteFile string) {
-	fmt.Println("Transfering file from remote...")
-	err := client.Connect()
+
+func (l *listValue) Set(value string) error {
+	*l = splitList(value)
+	return nil
+}
+
+// mapValue is a comma separated list of name=value pairs.
+type mapValue map[string]string
+
+func (m *mapValue) String() string {
+	var pairs []string
+	for name, value := range *m {
+		pairs = append(pairs, name+"="+value)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (m *mapValue) Set(value string) error {
+	pairs := map[string]string{}
+	for _, pair := range splitList(value) {
+		i := strings.Index(pair, "=")
+		if i < 1 {
+			return fmt.Errorf("%q is not name=value", pair)
+		}
+		pairs[pair[:i]] = pair[i+1:]
+	}
+	*m = pairs
+	return nil
+}
+
+// loadConfigFile applies the configuration file to cfg, then sets the flags
+// given on the command line again so they win over the file.
+func loadConfigFile(cfg *config.Config, file, profile string, explicit map[string]string) {
+	if file != "" {
+		if err := config.Load(file, profile, cfg); err != nil {
+			redact.Println(err.Error())
+			os.Exit(2)
+		}
+	}
+	for name, value := range explicit {
+		flag.Set(name, value)
+	}
+}
+
+// applySSHConfig uses the ~/.ssh/config entry of the remote address as
+// defaults: the settings are rebuilt from the defaults updated with the entry,
+// then the configuration file and flags are applied again, so they still win.
+func applySSHConfig(cfg *config.Config, file, profile string, explicit map[string]string) {
+	if cfg.Remote.SSHConfig == "none" {
+		return
+	}
+	host, err := sshConnection.LookupSSHConfig(cfg.Remote.SSHConfig, cfg.Remote.Addr)
 	if err != nil {
-		panic("Session not started" + err.Error())
+		redact.Println(err.Error())
+		os.Exit(2)
+	}
+	if host.HostName == "" && host.Port == "" && host.User == "" && len(host.IdentityFiles) == 0 && host.ProxyJump == "" {
+		return
+	}
+	*cfg = *config.Default()
+	if host.Port != "" {
+		cfg.Remote.Port = host.Port
+	}
+	if host.User != "" {
+		cfg.Remote.User = host.User
 	}
-	localFile, err := scp.Read(client, getRemoteTmpDir()+remoteFile)
+	if len(host.IdentityFiles) > 0 {
+		cfg.Remote.IdentityFiles = host.IdentityFiles
+	}
+	cfg.Remote.ProxyJump = host.ProxyJump
+	loadConfigFile(cfg, file, profile, explicit)
+	cfg.Remote.HostName = host.HostName
+}
+func runRemoteCmd(ctx context.Context, remote *remoteClient, cmds func(con sshConnection.ConnectionInt) []func() error) error {
+	status("Remote command...")
+	c, err := remote.get()
 	if err != nil {
-		panic("Transfer file failure" + err.Error())
+		return err
+	}
+	if dryRun != nil {
+		conn := plan.Connection{Plan: dryRun, Host: c.Host}
+		for _, f := range cmds(&conn) {
+			f()
+		}
+		return nil
+	}
+	if err := c.RunCommands(ctx, cmds); err != nil {
+		return err
 	}
-	err = saveFile(localFile, getLocalTmpDir(parameters)+remoteFile)
+	status("Remote command completed")
+	return nil
+}
+func copyFromRemote(ctx context.Context, remote *remoteClient, cfg *config.Config, remoteFile string) error {
+	status("Transfering file from remote...")
+	c, err := remote.get()
 	if err != nil {
-		panic("Transfer file failure" + err.Error())
+		return err
 	}
-	fmt.Println("Transfering file from remote completed")
+	if dryRun != nil {
+		dryRun.Transfer(c.Host+":"+getRemoteTmpDir()+remoteFile, cfg.LocalTmpDir()+remoteFile)
+		return nil
+	}
+	files, err := remote.transferer()
+	if err != nil {
+		return err
+	}
+	var sum string
+	err = c.Retry(ctx, func(ctx context.Context) error {
+		if err := files.Download(ctx, getRemoteTmpDir()+remoteFile, cfg.LocalTmpDir()+remoteFile); err != nil {
+			return err
+		}
+		sum, err = transfer.Verify(ctx, files, cfg.LocalTmpDir()+remoteFile, getRemoteTmpDir()+remoteFile)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	pipeline.RecordDigest(ctx, cfg.LocalTmpDir()+remoteFile, sum)
+	status("Transfering file from remote completed, sha256 " + sum)
+	return nil
 }
-func copyToRemote(client *sshConnection.Client, path, file string) {
-	fmt.Println("Transfering file to remote host...")
-	err := client.Connect()
+// copyDirToRemote uploads the directory dir of path to the remote tmp dir,
+// verifies every file and records their digests.
+func copyDirToRemote(ctx context.Context, remote *remoteClient, path, dir string) error {
+	status("Transfering directory to remote host...")
+	c, err := remote.get()
+	if err != nil {
+		return err
+	}
+	remoteDir := getRemoteTmpDir() + dir
+	if dryRun != nil {
+		dryRun.Transfer(path+dir+"/", c.Host+":"+remoteDir+"/")
+		return nil
+	}
+	files, err := remote.transferer()
+	if err != nil {
+		return err
+	}
+	var sums map[string]string
+	err = c.Retry(ctx, func(ctx context.Context) error {
+		var err error
+		if remote.cfg.Remote.ResumeUploads {
+			err = transfer.ResumeUploadDir(ctx, files, path+dir, remoteDir)
+		} else {
+			err = files.UploadDir(ctx, path+dir, remoteDir)
+		}
+		if err != nil {
+			return err
+		}
+		sums, err = transfer.VerifyDir(ctx, files, path+dir, remoteDir)
+		return err
+	})
 	if err != nil {
-		panic("Session not started" + err.Error())
+		return err
 	}
-	scp.CopyLocalToRemote(client, path+file, getRemoteTmpDir()+file)
-	client.Close()
-	fmt.Println("Transfering file to remote host completed")
-	fmt.Println("File avilable at:", getRemoteTmpDir()+file)
+	for file, sum := range sums {
+		pipeline.RecordDigest(ctx, file, sum)
+		status(file + " sha256 " + sum)
+	}
+	status("Transfering directory to remote host completed")
+	status("Directory avilable at:", remoteDir)
+	return nil
 }
 func clean(localFiles []string) {
 	for _, i := range localFiles {
@@ -374,55 +1021,54 @@ func clean(localFiles []string) {
 func getRemoteTmpDir() string {
 	return "/tmp/"
 }
-func getLocalTmpDir(parameters map[string]string) string {
-	if parameters["dir"] != "" {
-		return parameters["dir"]
-	}
-	return os.TempDir() + "/"
-}
-func prepareFileNames(parameters map[string]string) {
+func prepareFileNames(cfg *config.Config) {
 	dateTimeFormat := "2120061545"
 	fileTimestamp := time.Now().Format(dateTimeFormat)
-	remoteDbLogFileName := "remote_changelog" + fileTimestamp + ".sql"
-	localDbLogFileName := "local_changelog" + fileTimestamp + ".sql"
-	localProjectDir := getLocalTmpDir(parameters) + fileTimestamp
-	sqlFile := "UPDATE_" + fileTimestamp + ".sql"
-
-	parameters["remote-db-log-file-path"] = remoteDbLogFileName
-	parameters["local-db-log-file-path"] = localDbLogFileName
-	parameters["local-project-dir"] = localProjectDir
-	parameters["sql-file"] = sqlFile
-	parameters["file-timestamp"] = fileTimestamp
-}
-func getValue(parameters map[string]string, key string) string {
-	return parameters[key]
-}
-func createLiquibaseCmd(parameters map[string]string) []string {
-	dbUser := getValue(parameters, "local-db-user")
-	dbPassword := getValue(parameters, "local-db-password")
-	dbName := getValue(parameters, "local-db-name")
-	dbSchema := getValue(parameters, "local-db-schema")
-	liquiJar := getValue(parameters, "liquibase-path")
-	dbDriver := getValue(parameters, "db-driver-jar")
-	dbUrl := getValue(parameters, "local-db-url")
-	dbPort := getValue(parameters, "local-db-port")
-	context := getValue(parameters, "sql-context")
-	sqlFile := getLocalTmpDir(parameters) + getValue(parameters, "sql-file")
+	if cfg.Resume != "" {
+		fileTimestamp = cfg.Resume
+	}
+	cfg.SetRunID(fileTimestamp)
+}
+func createLiquibaseCmd(cfg *config.Config) []string {
+	db := cfg.LocalDB
+	liquibase := cfg.Liquibase
+	sqlFile := cfg.LocalTmpDir() + cfg.Files.SqlFile
 	return []string{
-		"-jar", liquiJar,
+		"-jar", liquibase.Path,
 		"--driver=org.postgresql.Driver",
-		"--classpath=" + dbDriver,
+		"--classpath=" + liquibase.DriverJar,
 		"--changeLogFile=liquibase\\changelog.xml",
-		"--url=jdbc:postgresql://" + dbUrl + ":" + dbPort + "/" + dbName,
-		"--username=" + dbUser,
-		"--password=" + dbPassword,
-		"--defaultSchemaName=" + dbSchema,
-		"--contexts=" + context,
+		"--url=jdbc:postgresql://" + db.URL + ":" + db.Port + "/" + db.Name,
+		"--username=" + db.User,
+		"--defaultsFile=" + cfg.LocalTmpDir() + cfg.Files.LiquibaseDefaults,
+		"--defaultSchemaName=" + db.Schema,
+		"--contexts=" + liquibase.Context,
 		"--outputFile=" + sqlFile,
 		"updateSql",
 	}
 }
 
+// writeLiquibaseDefaults writes the liquibase properties file with the local
+// db password, readable by the owner only.
+func writeLiquibaseDefaults(file, password string) error {
+	var value strings.Builder
+	for i, r := range password {
+		switch {
+		case r == '\\':
+			value.WriteString(`\\`)
+		case r == ' ' && i == 0:
+			value.WriteString(`\ `)
+		case r < ' ' || r > '~':
+			for _, u := range utf16.Encode([]rune{r}) {
+				fmt.Fprintf(&value, `\u%04x`, u)
+			}
+		default:
+			value.WriteRune(r)
+		}
+	}
+	return ioutil.WriteFile(file, []byte("password="+value.String()+"\n"), 0600)
+}
+
 func getEnvVariable(name string) string {
 	return os.Getenv(name)
 }
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"./config"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestParseArgPrecedence checks the order the settings are applied in:
+// defaults, ~/.ssh/config, the defaults of the config file, its profile and
+// the flags. parseArg registers the flags, so it can only run once.
+func TestParseArgPrecedence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "update")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sshConfig := filepath.Join(dir, "ssh_config")
+	err = ioutil.WriteFile(sshConfig, []byte("Host prod\n  HostName 10.1.1.1\n  Port 2200\n  User deploy\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configFile := filepath.Join(dir, "deploy.yml")
+	err = ioutil.WriteFile(configFile, []byte(`
+defaults:
+  version: "1.0"
+  remote:
+    addr: prod
+    user: fileuser
+    ssh-config: `+sshConfig+`
+  git:
+    branch: develop
+profiles:
+  prod:
+    git:
+      branch: release
+    remote-db:
+      name: profiledb
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	args := os.Args
+	defer func() { os.Args = args }()
+	os.Args = []string{"update", "-config", configFile, "-profile", "prod",
+		"-version", "2.0", "-remote-db-name", "flagdb", "-local-db-user", "flaguser"}
+	cfg := parseArg()
+
+	tests := []struct {
+		name, got, want string
+	}{
+		{"flag over file defaults", cfg.Version, "2.0"},
+		{"flag over profile", cfg.RemoteDB.Name, "flagdb"},
+		{"flag over defaults", cfg.LocalDB.User, "flaguser"},
+		{"profile over file defaults", cfg.Git.Branch, "release"},
+		{"file over ssh config", cfg.Remote.User, "fileuser"},
+		{"ssh config over defaults", cfg.Remote.Port, "2200"},
+		{"ssh config host name", cfg.Remote.HostName, "10.1.1.1"},
+		{"alias kept", cfg.Remote.Addr, "prod"},
+		{"defaults", cfg.Git.User, "username"},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s: %q, want %q", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+// TestRemoteDbLogDump runs the dump command in a local shell with pg_dump
+// replaced by a function printing its password and arguments.
+func TestRemoteDbLogDump(t *testing.T) {
+	cfg := config.Default()
+	cfg.RemoteDB.Password = "dbp'ass $HOME"
+	cfg.RemoteDB.User = "o'neil"
+	cfg.RemoteDB.Name = "app db"
+	cfg.Files.RemoteDbLogFile = "log;rm -rf x.sql"
+
+	cmd := remoteDbLogDump(cfg)
+	if strings.Contains(cmd.Line(), "dbp") {
+		t.Errorf("password on the command line: %s", cmd.Line())
+	}
+	sh := exec.Command("sh", "-c", `pg_dump() { printf '%s\n' "$PGPASSWORD" "$@"; }; `+cmd.Cmd)
+	sh.Stdin = strings.NewReader(cmd.Stdin)
+	out, err := sh.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	want := []string{"dbp'ass $HOME", "-U", "o'neil", "-d", "app db", "-h", cfg.RemoteDB.URL, "-p", cfg.RemoteDB.Port,
+		"-t", cfg.RemoteDB.Schema + ".databasechangelog", "-O", "-x", "-f", "/tmp/log;rm -rf x.sql"}
+	if got := strings.Split(strings.TrimSuffix(string(out), "\n"), "\n"); strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("pg_dump got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,330 @@
+package changelog
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Column is a column of the table as pg_dump describes it.
+type Column struct {
+	Name    string
+	Type    string
+	NotNull bool
+	// Default is the default expression, empty for none.
+	Default string
+}
+
+// Snapshot is the definition and content of the table. NULL values are nil.
+type Snapshot struct {
+	Schema  string
+	Table   string
+	Columns []Column
+	Rows    [][]*string
+}
+
+// WriteTo writes the snapshot in the plain format of pg_dump: the CREATE TABLE
+// statement followed by a COPY block with the rows.
+func (s *Snapshot) WriteTo(w io.Writer) (int64, error) {
+	name := pq.QuoteIdentifier(s.Schema) + "." + pq.QuoteIdentifier(s.Table)
+	b := &strings.Builder{}
+	b.WriteString("--\n-- Changelog snapshot of " + s.Schema + "." + s.Table + "\n--\n\n")
+	b.WriteString("SET client_encoding = 'UTF8';\nSET standard_conforming_strings = on;\n\n")
+	b.WriteString("CREATE TABLE " + name + " (\n")
+	names := make([]string, len(s.Columns))
+	for i, c := range s.Columns {
+		names[i] = pq.QuoteIdentifier(c.Name)
+		b.WriteString("    " + names[i] + " " + c.Type)
+		if c.Default != "" {
+			b.WriteString(" DEFAULT " + c.Default)
+		}
+		if c.NotNull {
+			b.WriteString(" NOT NULL")
+		}
+		if i < len(s.Columns)-1 {
+			b.WriteString(",")
+		}
+		b.WriteString("\n")
+	}
+	b.WriteString(");\n\n")
+	b.WriteString("COPY " + name + " (" + strings.Join(names, ", ") + ") FROM stdin;\n")
+	for _, row := range s.Rows {
+		for i, value := range row {
+			if i > 0 {
+				b.WriteString("\t")
+			}
+			if value == nil {
+				b.WriteString(`\N`)
+			} else {
+				b.WriteString(copyEscaper.Replace(*value))
+			}
+		}
+		b.WriteString("\n")
+	}
+	b.WriteString("\\.\n\n")
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// copyEscaper escapes a value for the text format of COPY.
+var copyEscaper = strings.NewReplacer(`\`, `\\`, "\b", `\b`, "\f", `\f`, "\n", `\n`, "\r", `\r`, "\t", `\t`, "\v", `\v`)
+
+// replay runs the statements of a plain SQL dump in tx. Comments and psql
+// meta commands (\connect, \restrict...) are skipped, COPY ... FROM stdin
+// blocks are loaded with the copy protocol. Settings the server does not know
+// (SET of a newer pg_dump) are ignored like psql does.
+func replay(ctx context.Context, tx *sql.Tx, dump io.Reader) error {
+	r := bufio.NewReader(dump)
+	var statement strings.Builder
+	var quote rune
+	line := 0
+	for {
+		text, err := r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if text == "" && err == io.EOF {
+			break
+		}
+		line++
+		text = strings.TrimRight(text, "\r\n")
+		if statement.Len() == 0 {
+			trimmed := strings.TrimSpace(text)
+			if trimmed == "" || strings.HasPrefix(trimmed, "--") || strings.HasPrefix(trimmed, `\`) {
+				if err == io.EOF {
+					break
+				}
+				continue
+			}
+		}
+		statement.WriteString(text + "\n")
+		quote = quotes(text, quote)
+		if quote == 0 && strings.HasSuffix(strings.TrimSpace(text), ";") {
+			stmt := strings.TrimSpace(statement.String())
+			statement.Reset()
+			if err := execute(ctx, tx, stmt, r, &line); err != nil {
+				return fmt.Errorf("line %d: %w", line, err)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	if strings.TrimSpace(statement.String()) != "" {
+		return fmt.Errorf("line %d: unterminated statement %q", line, statement.String())
+	}
+	return nil
+}
+
+// quotes returns the quote of the string literal or identifier still open at
+// the end of text, quote is the one open at its start.
+func quotes(text string, quote rune) rune {
+	for _, c := range text {
+		switch {
+		case quote == 0 && (c == '\'' || c == '"'):
+			quote = c
+		case c == quote:
+			quote = 0
+		}
+	}
+	return quote
+}
+
+func execute(ctx context.Context, tx *sql.Tx, statement string, r *bufio.Reader, line *int) error {
+	upper := strings.ToUpper(statement)
+	switch {
+	case strings.HasPrefix(upper, "COPY ") && strings.HasSuffix(upper, "FROM STDIN;"):
+		return copyIn(ctx, tx, statement, r, line)
+	case strings.HasPrefix(upper, "SET ") || strings.HasPrefix(upper, "SELECT PG_CATALOG.SET_CONFIG("):
+		if _, err := tx.ExecContext(ctx, "SAVEPOINT setting"); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			_, err = tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT setting")
+			return err
+		}
+		_, err := tx.ExecContext(ctx, "RELEASE SAVEPOINT setting")
+		return err
+	}
+	_, err := tx.ExecContext(ctx, statement)
+	return err
+}
+
+// copyIn loads the rows following a COPY table (columns) FROM stdin; statement
+// up to the \. line.
+func copyIn(ctx context.Context, tx *sql.Tx, statement string, r *bufio.Reader, line *int) error {
+	schema, table, columns, err := parseCopy(statement)
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.PrepareContext(ctx, pq.CopyInSchema(schema, table, columns...))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for {
+		text, err := r.ReadString('\n')
+		if err == io.EOF && text == "" {
+			return fmt.Errorf("COPY data of %s.%s ends without \\.", schema, table)
+		} else if err != nil && err != io.EOF {
+			return err
+		}
+		*line++
+		text = strings.TrimRight(text, "\r\n")
+		if text == `\.` {
+			break
+		}
+		fields := strings.Split(text, "\t")
+		if len(fields) != len(columns) {
+			return fmt.Errorf("COPY row has %d values for %d columns", len(fields), len(columns))
+		}
+		values := make([]interface{}, len(fields))
+		for i, f := range fields {
+			if f == `\N` {
+				continue
+			}
+			values[i] = unescape(f)
+		}
+		if _, err := stmt.ExecContext(ctx, values...); err != nil {
+			return err
+		}
+	}
+	_, err = stmt.ExecContext(ctx)
+	return err
+}
+
+// parseCopy reads schema, table and columns of
+// COPY schema.table (col, ...) FROM stdin;
+func parseCopy(statement string) (schema, table string, columns []string, err error) {
+	rest := strings.TrimSpace(statement[len("COPY "):])
+	names, rest, err := identifiers(rest, '.')
+	if err != nil {
+		return "", "", nil, err
+	}
+	switch len(names) {
+	case 1:
+		schema, table = "public", names[0]
+	case 2:
+		schema, table = names[0], names[1]
+	default:
+		return "", "", nil, fmt.Errorf("invalid table in %q", statement)
+	}
+	rest = strings.TrimSpace(rest)
+	if !strings.HasPrefix(rest, "(") {
+		return "", "", nil, fmt.Errorf("COPY without column list %q", statement)
+	}
+	columns, rest, err = identifiers(strings.TrimSpace(rest[1:]), ',')
+	if err != nil {
+		return "", "", nil, err
+	}
+	if !strings.HasPrefix(strings.TrimSpace(rest), ")") {
+		return "", "", nil, fmt.Errorf("invalid column list in %q", statement)
+	}
+	return schema, table, columns, nil
+}
+
+// identifiers reads identifiers separated by sep, quoted ones with "" escapes
+// and unquoted ones folded to lower case, and returns the text after them.
+func identifiers(s string, sep byte) ([]string, string, error) {
+	var names []string
+	for {
+		s = strings.TrimLeft(s, " ")
+		var name string
+		if strings.HasPrefix(s, `"`) {
+			end := 1
+			for {
+				i := strings.IndexByte(s[end:], '"')
+				if i < 0 {
+					return nil, "", fmt.Errorf("unterminated identifier %q", s)
+				}
+				end += i + 1
+				if end < len(s) && s[end] == '"' {
+					end++
+					continue
+				}
+				break
+			}
+			name = strings.Replace(s[1:end-1], `""`, `"`, -1)
+			s = s[end:]
+		} else {
+			end := strings.IndexAny(s, " ,.()")
+			if end < 0 {
+				end = len(s)
+			}
+			name = strings.ToLower(s[:end])
+			s = s[end:]
+		}
+		if name == "" {
+			return nil, "", fmt.Errorf("missing identifier before %q", s)
+		}
+		names = append(names, name)
+		s = strings.TrimLeft(s, " ")
+		if len(s) == 0 || s[0] != sep {
+			return names, s, nil
+		}
+		s = s[1:]
+	}
+}
+
+// unescape decodes a value of the text format of COPY.
+func unescape(f string) string {
+	if !strings.Contains(f, `\`) {
+		return f
+	}
+	var b strings.Builder
+	for i := 0; i < len(f); i++ {
+		c := f[i]
+		if c != '\\' || i == len(f)-1 {
+			b.WriteByte(c)
+			continue
+		}
+		i++
+		switch c = f[i]; c {
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case 'v':
+			b.WriteByte('\v')
+		case 'x':
+			j := i + 1
+			for j < len(f) && j < i+3 && isHex(f[j]) {
+				j++
+			}
+			if j == i+1 {
+				b.WriteByte('x')
+				continue
+			}
+			n, _ := strconv.ParseUint(f[i+1:j], 16, 8)
+			b.WriteByte(byte(n))
+			i = j - 1
+		case '0', '1', '2', '3', '4', '5', '6', '7':
+			j := i
+			for j < len(f) && j < i+3 && f[j] >= '0' && f[j] <= '7' {
+				j++
+			}
+			n, _ := strconv.ParseUint(f[i:j], 8, 8)
+			b.WriteByte(byte(n))
+			i = j - 1
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
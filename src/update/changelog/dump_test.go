@@ -0,0 +1,333 @@
+package changelog
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+// recorder is a database/sql driver keeping what is executed through it: the
+// statements in order and the rows of every COPY by its statement. Statements
+// in fail return an error.
+type recorder struct {
+	statements []string
+	rows       map[string][][]*string
+	fail       map[string]bool
+}
+
+func (r *recorder) Connect(context.Context) (driver.Conn, error) { return r, nil }
+func (r *recorder) Driver() driver.Driver                        { return nil }
+func (r *recorder) Prepare(query string) (driver.Stmt, error)    { return &statement{r, query}, nil }
+func (r *recorder) Close() error                                 { return nil }
+func (r *recorder) Begin() (driver.Tx, error)                    { return r, nil }
+func (r *recorder) Commit() error                                { return nil }
+func (r *recorder) Rollback() error                              { return nil }
+
+type statement struct {
+	r     *recorder
+	query string
+}
+
+func (s *statement) Close() error  { return nil }
+func (s *statement) NumInput() int { return -1 }
+
+func (s *statement) Exec(args []driver.Value) (driver.Result, error) {
+	if !strings.HasPrefix(s.query, "COPY ") {
+		s.r.statements = append(s.r.statements, s.query)
+		if s.r.fail[s.query] {
+			return nil, errors.New("unrecognized configuration parameter")
+		}
+		return driver.RowsAffected(0), nil
+	}
+	// lib/pq ends the copy with an Exec without values
+	if len(args) == 0 {
+		return driver.RowsAffected(0), nil
+	}
+	row := make([]*string, len(args))
+	for i, a := range args {
+		if a != nil {
+			value := a.(string)
+			row[i] = &value
+		}
+	}
+	s.r.rows[s.query] = append(s.r.rows[s.query], row)
+	return driver.RowsAffected(1), nil
+}
+
+func (s *statement) Query([]driver.Value) (driver.Rows, error) {
+	return nil, errors.New("not supported")
+}
+
+// replayed runs replay of dump in a transaction of a recorder failing the
+// statements fail.
+func replayed(t *testing.T, dump string, fail ...string) (*recorder, error) {
+	t.Helper()
+	r := &recorder{rows: map[string][][]*string{}, fail: map[string]bool{}}
+	for _, f := range fail {
+		r.fail[f] = true
+	}
+	tx, err := sql.OpenDB(r).BeginTx(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	return r, replay(context.Background(), tx, strings.NewReader(dump))
+}
+
+func str(s string) *string {
+	return &s
+}
+
+// show prints rows with NULL for nil values.
+func show(rows [][]*string) string {
+	var b strings.Builder
+	for _, row := range rows {
+		for i, v := range row {
+			if i > 0 {
+				b.WriteString(" | ")
+			}
+			if v == nil {
+				b.WriteString("NULL")
+			} else {
+				fmt.Fprintf(&b, "%q", *v)
+			}
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	text := []Column{{Name: "id", Type: "character varying(255)", NotNull: true}, {Name: "comments", Type: "text"}}
+	tests := []struct {
+		name     string
+		snapshot Snapshot
+	}{
+		{"plain", Snapshot{
+			Schema: "public", Table: Table, Columns: text,
+			Rows: [][]*string{{str("1"), str("createTable tableName=customer")}, {str("2"), str("")}},
+		}},
+		{"no rows", Snapshot{Schema: "public", Table: Table, Columns: text}},
+		{"nulls", Snapshot{
+			Schema: "public", Table: Table, Columns: text,
+			Rows: [][]*string{{str("1"), nil}, {nil, nil}, {str(""), str("")}, {str(`\N`), str("NULL")}},
+		}},
+		{"tabs and line breaks", Snapshot{
+			Schema: "public", Table: Table, Columns: text,
+			Rows: [][]*string{
+				{str("1"), str("a\tb\t")},
+				{str("2"), str("line\nnext\r\nlast\n")},
+				{str("3"), str("\b\f\v")},
+			},
+		}},
+		{"backslashes", Snapshot{
+			Schema: "public", Table: Table, Columns: text,
+			Rows: [][]*string{
+				{str("1"), str(`C:\deploy\new`)},
+				{str("2"), str(`\`)},
+				{str(`\.`), str(`\\.`)},
+				{str("4"), str(`\t\x41\101`)},
+			},
+		}},
+		{"unicode", Snapshot{
+			Schema: "public", Table: Table, Columns: text,
+			Rows: [][]*string{{str("1"), str("zażółć gęślą jaźń")}},
+		}},
+		{"quoted identifiers", Snapshot{
+			Schema: "My Schema", Table: `data"base`,
+			Columns: []Column{
+				{Name: "ID", Type: "integer", NotNull: true},
+				{Name: `Odd "Col"`, Type: "text", Default: `'it''s'::text`},
+				{Name: "semi;colon", Type: "text", Default: "'a;\nb'::text"},
+				{Name: "with.dot, comma", Type: "text"},
+			},
+			Rows: [][]*string{{str("1"), str(`"quoted"`), str("x;"), nil}},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var dump bytes.Buffer
+			if _, err := tt.snapshot.WriteTo(&dump); err != nil {
+				t.Fatal(err)
+			}
+			r, err := replayed(t, dump.String())
+			if err != nil {
+				t.Fatalf("replay: %v\n%s", err, dump.String())
+			}
+			out := dump.String()
+			create := out[strings.Index(out, "CREATE TABLE") : strings.Index(out, ");\n\nCOPY")+2]
+			if last := r.statements[len(r.statements)-1]; last != create {
+				t.Errorf("executed\n%s\nwant\n%s", last, create)
+			}
+			names := make([]string, len(tt.snapshot.Columns))
+			for i, c := range tt.snapshot.Columns {
+				names[i] = c.Name
+			}
+			stmt := pq.CopyInSchema(tt.snapshot.Schema, tt.snapshot.Table, names...)
+			if len(r.rows) > 1 || len(r.rows) == 1 && r.rows[stmt] == nil {
+				t.Fatalf("copied into %v, want %s", r.rows, stmt)
+			}
+			if got := r.rows[stmt]; !reflect.DeepEqual(got, tt.snapshot.Rows) {
+				t.Errorf("rows\n%swant\n%s", show(got), show(tt.snapshot.Rows))
+			}
+		})
+	}
+}
+
+func TestReplayPgDump(t *testing.T) {
+	dump, err := ioutil.ReadFile("testdata/databasechangelog.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a 16 server does not know the setting of pg_dump 17
+	r, err := replayed(t, string(dump), "SET transaction_timeout = 0;")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var executed []string
+	for _, s := range r.statements {
+		if !strings.HasSuffix(s, "SAVEPOINT setting") {
+			executed = append(executed, strings.SplitN(s, "\n", 2)[0])
+		}
+	}
+	want := []string{
+		"SET statement_timeout = 0;",
+		"SET lock_timeout = 0;",
+		"SET idle_in_transaction_session_timeout = 0;",
+		"SET transaction_timeout = 0;",
+		"SET client_encoding = 'UTF8';",
+		"SET standard_conforming_strings = on;",
+		"SELECT pg_catalog.set_config('search_path', '', false);",
+		"SET check_function_bodies = false;",
+		"SET xmloption = content;",
+		"SET client_min_messages = warning;",
+		"SET row_security = off;",
+		"SET default_tablespace = '';",
+		"SET default_table_access_method = heap;",
+		"CREATE TABLE public.databasechangelog (",
+		"ALTER TABLE public.databasechangelog OWNER TO app;",
+	}
+	if !reflect.DeepEqual(executed, want) {
+		t.Errorf("executed\n%s\nwant\n%s", strings.Join(executed, "\n"), strings.Join(want, "\n"))
+	}
+	// the failed setting is rolled back, the others released
+	for i, s := range r.statements {
+		if s == "SET transaction_timeout = 0;" && r.statements[i+1] != "ROLLBACK TO SAVEPOINT setting" {
+			t.Errorf("%s followed by %s", s, r.statements[i+1])
+		}
+		if s == "SET lock_timeout = 0;" && r.statements[i+1] != "RELEASE SAVEPOINT setting" {
+			t.Errorf("%s followed by %s", s, r.statements[i+1])
+		}
+	}
+
+	columns := []string{"id", "author", "filename", "dateexecuted", "orderexecuted", "exectype", "md5sum",
+		"description", "comments", "tag", "liquibase", "contexts", "labels", "deployment_id"}
+	rows := [][]*string{
+		{str("1709288130-1"), str("bartosz"), str("db/changelog/1.0/customer.xml"), str("2024-03-01 10:15:30.123456"),
+			str("1"), str("EXECUTED"), str("9:0a6a5c5d1e5e0a4b5e2b8a1b7f0d3c21"), str("createTable tableName=customer"),
+			str(""), nil, str("4.25.1"), str("prod"), nil, str("9288130001")},
+		{str("1709288130-2"), str("bartosz"), str("db/changelog/1.0/customer.xml"), str("2024-03-01 10:15:30.234567"),
+			str("2"), str("EXECUTED"), str("9:7b1c2d3e4f5a6b7c8d9e0f1a2b3c4d5e"), str("sql"),
+			str("Tab\there, new line\nand C:\\deploy\\sql"), str("v1.0"), str("4.25.1"), str("prod,test"), nil, str("9288130001")},
+		{str("1709288130-3"), str("zażółć"), str("db/changelog/1.1/order.xml"), str("2024-04-12 08:00:00"),
+			str("3"), str("MARK_RAN"), nil, str(`addColumn tableName="order"`),
+			nil, nil, str("4.25.1"), nil, nil, str("2910000002")},
+	}
+	stmt := pq.CopyInSchema("public", Table, columns...)
+	if got := r.rows[stmt]; !reflect.DeepEqual(got, rows) {
+		t.Errorf("rows of %s\n%swant\n%s", stmt, show(got), show(rows))
+	}
+}
+
+func TestReplayErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		dump string
+		want string
+	}{
+		{"unterminated statement", "CREATE TABLE t (id integer)\n", "unterminated statement"},
+		{"unterminated literal", "INSERT INTO t VALUES ('a;\n", "unterminated statement"},
+		{"COPY without end", "COPY t (id) FROM stdin;\n1\n", `ends without \.`},
+		{"COPY row too short", "COPY t (id, name) FROM stdin;\n1\n\\.\n", "1 values for 2 columns"},
+		{"COPY without columns", "COPY t FROM stdin;\n\\.\n", "without column list"},
+		{"failed statement", "CREATE TABLE t (id integer);\n", "line 1: unrecognized"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := replayed(t, tt.dump, "CREATE TABLE t (id integer);")
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("err = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseCopy(t *testing.T) {
+	tests := []struct {
+		statement string
+		schema    string
+		table     string
+		columns   []string
+	}{
+		{"COPY public.databasechangelog (id, author) FROM stdin;", "public", "databasechangelog", []string{"id", "author"}},
+		{"COPY databasechangelog (id) FROM stdin;", "public", "databasechangelog", []string{"id"}},
+		{"COPY App.DatabaseChangeLog (ID, Author) FROM stdin;", "app", "databasechangelog", []string{"id", "author"}},
+		{`COPY "My Schema"."data""base" ("ID", "Odd ""Col""", "with.dot, comma") FROM stdin;`,
+			"My Schema", `data"base`, []string{"ID", `Odd "Col"`, "with.dot, comma"}},
+	}
+	for _, tt := range tests {
+		schema, table, columns, err := parseCopy(tt.statement)
+		if err != nil {
+			t.Errorf("%s: %v", tt.statement, err)
+			continue
+		}
+		if schema != tt.schema || table != tt.table || !reflect.DeepEqual(columns, tt.columns) {
+			t.Errorf("%s: %q %q %q, want %q %q %q", tt.statement, schema, table, columns, tt.schema, tt.table, tt.columns)
+		}
+	}
+
+	for _, statement := range []string{
+		"COPY a.b.c (id) FROM stdin;",
+		`COPY "open (id) FROM stdin;`,
+		"COPY t (id FROM stdin;",
+		"COPY t () FROM stdin;",
+	} {
+		if _, _, _, err := parseCopy(statement); err == nil {
+			t.Errorf("%s: no error", statement)
+		}
+	}
+}
+
+func TestUnescape(t *testing.T) {
+	tests := []struct {
+		field string
+		want  string
+	}{
+		{"plain", "plain"},
+		{`a\tb\nc\rd`, "a\tb\nc\rd"},
+		{`\b\f\v`, "\b\f\v"},
+		{`C:\\deploy`, `C:\deploy`},
+		{`\\N`, `\N`},
+		{`\101\60x`, "A0x"},
+		{`\x41\x4a\x4Z`, "AJ\x04Z"},
+		{`\xZ`, "xZ"},
+		{`\q`, "q"},
+		{`end\`, `end\`},
+		{`za\305\274\303\263\305\202`, "zażół"},
+	}
+	for _, tt := range tests {
+		if got := unescape(tt.field); got != tt.want {
+			t.Errorf("unescape(%q) = %q, want %q", tt.field, got, tt.want)
+		}
+	}
+}
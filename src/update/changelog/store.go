@@ -0,0 +1,211 @@
+package changelog
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Table is where Liquibase records the executed change sets.
+const Table = "databasechangelog"
+
+// ErrNotFound is returned when the schema has no changelog table.
+var ErrNotFound = errors.New("changelog table not found")
+
+// Connection addresses the database holding the changelog. SSLMode is one
+// of disable, require, verify-ca or verify-full, default disable.
+type Connection struct {
+	Host     string
+	Port     string
+	User     string
+	Password string
+	Name     string
+	Schema   string
+	SSLMode  string
+}
+
+// dsn is the connection string of lib/pq, every value quoted.
+func (c Connection) dsn() string {
+	sslMode := c.SSLMode
+	if sslMode == "" {
+		sslMode = "disable"
+	}
+	values := []struct{ key, value string }{
+		{"host", c.Host}, {"port", c.Port}, {"user", c.User},
+		{"password", c.Password}, {"dbname", c.Name}, {"sslmode", sslMode},
+	}
+	var parts []string
+	for _, v := range values {
+		if v.value == "" {
+			continue
+		}
+		quoted := strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(v.value)
+		parts = append(parts, v.key+"='"+quoted+"'")
+	}
+	return strings.Join(parts, " ")
+}
+
+// Store reads and writes the changelog table of one schema. It talks to the
+// database directly, no PostgreSQL client programs are needed.
+type Store struct {
+	db     *sql.DB
+	schema string
+}
+
+// Open prepares the connection, the database is contacted by the first
+// operation.
+func Open(c Connection) (*Store, error) {
+	db, err := sql.Open("postgres", c.dsn())
+	if err != nil {
+		return nil, err
+	}
+	return &Store{db: db, schema: c.Schema}, nil
+}
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Name is the schema qualified table name, quoted.
+func (s *Store) Name() string {
+	return pq.QuoteIdentifier(s.schema) + "." + pq.QuoteIdentifier(Table)
+}
+
+// Read returns the columns and rows of the table, read in one transaction.
+// ErrNotFound means there is no table.
+func (s *Store) Read(ctx context.Context) (*Snapshot, error) {
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	snapshot := &Snapshot{Schema: s.schema, Table: Table}
+	if snapshot.Columns, err = s.columns(ctx, tx); err != nil {
+		return nil, err
+	}
+	names := make([]string, len(snapshot.Columns))
+	for i, c := range snapshot.Columns {
+		names[i] = pq.QuoteIdentifier(c.Name) + "::text"
+	}
+	rows, err := tx.QueryContext(ctx, "SELECT "+strings.Join(names, ", ")+" FROM "+s.Name())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		values := make([]sql.NullString, len(names))
+		dest := make([]interface{}, len(names))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		row := make([]*string, len(values))
+		for i, v := range values {
+			if v.Valid {
+				value := v.String
+				row[i] = &value
+			}
+		}
+		snapshot.Rows = append(snapshot.Rows, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return snapshot, tx.Commit()
+}
+
+func (s *Store) columns(ctx context.Context, tx *sql.Tx) ([]Column, error) {
+	var exists sql.NullString
+	if err := tx.QueryRowContext(ctx, "SELECT pg_catalog.to_regclass($1)::text", s.Name()).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if !exists.Valid {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, s.Name())
+	}
+	rows, err := tx.QueryContext(ctx, `SELECT a.attname, pg_catalog.format_type(a.atttypid, a.atttypmod), a.attnotnull,
+		pg_catalog.pg_get_expr(d.adbin, d.adrelid)
+	FROM pg_catalog.pg_attribute a
+	LEFT JOIN pg_catalog.pg_attrdef d ON d.adrelid = a.attrelid AND d.adnum = a.attnum
+	WHERE a.attrelid = pg_catalog.to_regclass($1) AND a.attnum > 0 AND NOT a.attisdropped
+	ORDER BY a.attnum`, s.Name())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var columns []Column
+	for rows.Next() {
+		var c Column
+		var def sql.NullString
+		if err := rows.Scan(&c.Name, &c.Type, &c.NotNull, &def); err != nil {
+			return nil, err
+		}
+		c.Default = def.String
+		columns = append(columns, c)
+	}
+	return columns, rows.Err()
+}
+
+// Snapshot writes the table to file as a plain SQL dump that Restore (or psql)
+// reads back. The file is replaced only once complete.
+func (s *Store) Snapshot(ctx context.Context, file string) error {
+	snapshot, err := s.Read(ctx)
+	if err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := snapshot.WriteTo(f); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// Drop removes the table if it exists.
+func (s *Store) Drop(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, "DROP TABLE IF EXISTS "+s.Name())
+	return err
+}
+
+// Restore replaces the table by the content of a plain SQL dump, written by
+// Snapshot or pg_dump -F p, in one transaction: when the dump fails the table
+// is left as it was.
+func (s *Store) Restore(ctx context.Context, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return s.restore(ctx, f)
+}
+
+func (s *Store) restore(ctx context.Context, dump io.Reader) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, "DROP TABLE IF EXISTS "+s.Name()); err != nil {
+		return err
+	}
+	if err := replay(ctx, tx, dump); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,66 @@
+--
+-- PostgreSQL database dump
+--
+
+\restrict 3Ydc7bDkVqXyfS8mM0ZbLh2LR9VQkQ1ZjJ7dYgqf8n5eCq0oH4a0rZtW6uN1bX
+
+-- Dumped from database version 16.10 (Debian 16.10-1.pgdg120+1)
+-- Dumped by pg_dump version 17.6 (Debian 17.6-1.pgdg120+1)
+
+SET statement_timeout = 0;
+SET lock_timeout = 0;
+SET idle_in_transaction_session_timeout = 0;
+SET transaction_timeout = 0;
+SET client_encoding = 'UTF8';
+SET standard_conforming_strings = on;
+SELECT pg_catalog.set_config('search_path', '', false);
+SET check_function_bodies = false;
+SET xmloption = content;
+SET client_min_messages = warning;
+SET row_security = off;
+
+SET default_tablespace = '';
+
+SET default_table_access_method = heap;
+
+--
+-- Name: databasechangelog; Type: TABLE; Schema: public; Owner: app
+--
+
+CREATE TABLE public.databasechangelog (
+    id character varying(255) NOT NULL,
+    author character varying(255) NOT NULL,
+    filename character varying(255) NOT NULL,
+    dateexecuted timestamp without time zone NOT NULL,
+    orderexecuted integer NOT NULL,
+    exectype character varying(10) NOT NULL,
+    md5sum character varying(35),
+    description character varying(255),
+    comments character varying(255),
+    tag character varying(255),
+    liquibase character varying(20),
+    contexts character varying(255),
+    labels character varying(255),
+    deployment_id character varying(10)
+);
+
+
+ALTER TABLE public.databasechangelog OWNER TO app;
+
+--
+-- Data for Name: databasechangelog; Type: TABLE DATA; Schema: public; Owner: app
+--
+
+COPY public.databasechangelog (id, author, filename, dateexecuted, orderexecuted, exectype, md5sum, description, comments, tag, liquibase, contexts, labels, deployment_id) FROM stdin;
+1709288130-1	bartosz	db/changelog/1.0/customer.xml	2024-03-01 10:15:30.123456	1	EXECUTED	9:0a6a5c5d1e5e0a4b5e2b8a1b7f0d3c21	createTable tableName=customer		\N	4.25.1	prod	\N	9288130001
+1709288130-2	bartosz	db/changelog/1.0/customer.xml	2024-03-01 10:15:30.234567	2	EXECUTED	9:7b1c2d3e4f5a6b7c8d9e0f1a2b3c4d5e	sql	Tab\there, new line\nand C:\\deploy\\sql	v1.0	4.25.1	prod,test	\N	9288130001
+1709288130-3	zażółć	db/changelog/1.1/order.xml	2024-04-12 08:00:00	3	MARK_RAN	\N	addColumn tableName="order"	\N	\N	4.25.1	\N	\N	2910000002
+\.
+
+
+--
+-- PostgreSQL database dump complete
+--
+
+\unrestrict 3Ydc7bDkVqXyfS8mM0ZbLh2LR9VQkQ1ZjJ7dYgqf8n5eCq0oH4a0rZtW6uN1bX
+
@@ -0,0 +1,631 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"../secret"
+	"gopkg.in/yaml.v2"
+)
+
+// Config holds every setting of a run. It is filled from the defaults, the
+// configuration file and the command line flags, in that order.
+type Config struct {
+	Version   string    `yaml:"version"`
+	Dir       string    `yaml:"dir"`
+	Remote    Remote    `yaml:"remote"`
+	RemoteDB  Database  `yaml:"remote-db"`
+	LocalDB   Database  `yaml:"local-db"`
+	Git       Git       `yaml:"git"`
+	Liquibase Liquibase `yaml:"liquibase"`
+	Steps     string    `yaml:"steps"`
+	SkipSteps string    `yaml:"skip-steps"`
+	Timeouts  Timeouts  `yaml:"timeouts"`
+	// Keystore is the encrypted file read by keystore: secret references,
+	// KeystorePassphrase a reference to its passphrase.
+	Keystore           string `yaml:"keystore"`
+	KeystorePassphrase string `yaml:"keystore-passphrase"`
+	// ProgressEvents is a file the transfer progress is appended to as JSON
+	// lines.
+	ProgressEvents string `yaml:"progress-events"`
+
+	// Run options, only given on the command line.
+	Resume string `yaml:"-"`
+	Plan   bool   `yaml:"-"`
+	// Files are derived from the run id, see SetRunID.
+	Files Files `yaml:"-"`
+}
+
+type Remote struct {
+	Addr            string `yaml:"addr"`
+	Port            string `yaml:"port"`
+	User            string `yaml:"user"`
+	Password        string `yaml:"password"`
+	WildflyPassword string `yaml:"wildfly-password"`
+	UseKey          bool   `yaml:"use-key"`
+	// RunAsUser runs the remote commands as another user, with RunAsMethod
+	// su, sudo or sudo-password and WildflyPassword as password.
+	RunAsUser   string `yaml:"run-as-user"`
+	RunAsMethod string `yaml:"run-as-method"`
+	// HostKeyMode is known-hosts, fingerprint, tofu or insecure.
+	HostKeyMode        string `yaml:"host-key-mode"`
+	KnownHosts         string `yaml:"known-hosts"`
+	HostKeyFingerprint string `yaml:"host-key-fingerprint"`
+	// AuthMethods is the order of agent, key, password and
+	// keyboard-interactive authentication.
+	AuthMethods   []string `yaml:"auth-methods"`
+	IdentityFiles []string `yaml:"identity-files"`
+	KeyPassphrase string   `yaml:"key-passphrase"`
+	// SSHConfig is the OpenSSH client config consulted for Addr, none
+	// disables it. HostName is the address resolved from it.
+	SSHConfig string `yaml:"ssh-config"`
+	HostName  string `yaml:"-"`
+	// ProxyJump lists jump hosts as [user@]host[:port],... using the auth of
+	// the remote host. JumpHosts configures them with their own auth and
+	// takes precedence.
+	ProxyJump string     `yaml:"proxy-jump"`
+	JumpHosts []JumpHost `yaml:"jump-hosts"`
+	// KeepAlive is the interval of keepalive requests, 0 disables them;
+	// KeepAliveCountMax unanswered ones mark the connection dead.
+	// ReconnectAttempts is how often a dropped connection is restored and an
+	// interrupted transfer repeated.
+	KeepAlive         string `yaml:"keepalive"`
+	KeepAliveCountMax int    `yaml:"keepalive-count-max"`
+	ReconnectAttempts int    `yaml:"reconnect-attempts"`
+	// Transfer is the file transfer protocol: auto, sftp or scp. auto uses
+	// sftp when the host offers it.
+	Transfer string `yaml:"transfer"`
+	// ResumeUploads continues an interrupted upload from the partial remote
+	// file instead of sending the whole file again.
+	ResumeUploads bool `yaml:"resume-uploads"`
+	// BandwidthLimit caps the transfers in bytes per second, with an
+	// optional K, M or G suffix (1024 based); empty or 0 means no limit.
+	BandwidthLimit string `yaml:"bandwidth-limit"`
+	// UploadMode are the octal permissions of uploaded files, e.g. 0640;
+	// empty keeps those of the local files. Directories keep their own.
+	UploadMode string `yaml:"upload-mode"`
+}
+
+// JumpHost is a bastion the remote host is reached through.
+type JumpHost struct {
+	// Port defaults to 22, User to the user of the remote host.
+	Addr               string   `yaml:"addr"`
+	Port               string   `yaml:"port"`
+	User               string   `yaml:"user"`
+	Password           string   `yaml:"password"`
+	AuthMethods        []string `yaml:"auth-methods"`
+	IdentityFiles      []string `yaml:"identity-files"`
+	KeyPassphrase      string   `yaml:"key-passphrase"`
+	HostKeyFingerprint string   `yaml:"host-key-fingerprint"`
+}
+
+// Timeouts are durations like 90s or 10m, empty means no limit.
+type Timeouts struct {
+	// Step limits every step, Steps overrides it per step name.
+	Step  string            `yaml:"step"`
+	Steps map[string]string `yaml:"steps"`
+	// Command limits every local and remote command.
+	Command string `yaml:"command"`
+}
+
+type Database struct {
+	Name     string `yaml:"name"`
+	Schema   string `yaml:"schema"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+	URL      string `yaml:"url"`
+	Port     string `yaml:"port"`
+	// SSLMode of the local database connection: disable, require, verify-ca
+	// or verify-full.
+	SSLMode string `yaml:"sslmode"`
+}
+
+type Git struct {
+	RepoURL  string `yaml:"repo-url"`
+	Branch   string `yaml:"branch"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+}
+
+type Liquibase struct {
+	Path      string `yaml:"path"`
+	DriverJar string `yaml:"db-driver"`
+	Context   string `yaml:"context"`
+	SrcRoot   string `yaml:"src-root"`
+}
+
+// Files are the names of the files created by a run. Names are relative to
+// the local or remote tmp dir, directories end with a slash.
+type Files struct {
+	Timestamp       string
+	RemoteDbLogFile string
+	LocalDbLogFile  string
+	LocalProjectDir string
+	SqlFile         string
+	// LiquibaseDefaults holds the local db password for liquibase while
+	// sql-diff runs.
+	LiquibaseDefaults string
+}
+
+// Default returns the configuration used when nothing is given.
+func Default() *Config {
+	return &Config{
+		Version:            "no-ver",
+		KeystorePassphrase: "env:DEPLOY_KEYSTORE_PASSPHRASE",
+		Remote: Remote{
+			Addr:        "127.0.0.1",
+			Port:        "22",
+			User:        "wildfly",
+			UseKey:      true,
+			RunAsUser:   "wildfly",
+			RunAsMethod: "su",
+			SSHConfig:   "~/.ssh/config",
+
+			KeepAlive:         "15s",
+			KeepAliveCountMax: 3,
+			ReconnectAttempts: 3,
+			Transfer:          "auto",
+			ResumeUploads:     true,
+		},
+		RemoteDB: Database{
+			Name:   "remoteDBName",
+			Schema: "remoteDBScehma",
+			User:   "remoteDBUser",
+			URL:    "localhost",
+			Port:   "5432",
+		},
+		LocalDB: Database{
+			Name:    "localDbName",
+			Schema:  "localDbSchema",
+			User:    "username",
+			URL:     "localhost",
+			Port:    "5432",
+			SSLMode: "disable",
+		},
+		Git: Git{
+			RepoURL: "git.name.pl/name1/name2",
+			Branch:  "master",
+			User:    "username",
+		},
+		Liquibase: Liquibase{
+			Path:      "D:/liquibase/liquibase.jar",
+			DriverJar: "D:/liquibase/postgresql-42.1.4.jar",
+			Context:   "prod",
+			SrcRoot:   "directoryName",
+		},
+	}
+}
+
+// LocalTmpDir is the directory holding the local files of a run.
+func (c *Config) LocalTmpDir() string {
+	if c.Dir != "" {
+		return c.Dir
+	}
+	return os.TempDir() + "/"
+}
+
+// ProjectDir is the directory of the cloned repository.
+func (c *Config) ProjectDir() string {
+	return c.LocalTmpDir() + c.Files.LocalProjectDir + c.Git.ProjectName()
+}
+
+// ProjectName is the last element of the repository url.
+func (g Git) ProjectName() string {
+	return g.RepoURL[strings.LastIndex(g.RepoURL, "/")+1:]
+}
+
+// Address returns host:port of the remote host, Addr may be an alias
+// resolved through the ssh config.
+func (r Remote) Address() string {
+	if r.HostName != "" {
+		return r.HostName + ":" + r.Port
+	}
+	return r.Addr + ":" + r.Port
+}
+
+func (t Timeouts) StepTimeout() time.Duration {
+	return duration(t.Step)
+}
+
+// StepTimeouts returns the per step limits.
+func (t Timeouts) StepTimeouts() map[string]time.Duration {
+	timeouts := map[string]time.Duration{}
+	for name, d := range t.Steps {
+		timeouts[name] = duration(d)
+	}
+	return timeouts
+}
+
+func (t Timeouts) CommandTimeout() time.Duration {
+	return duration(t.Command)
+}
+
+// duration parses a validated duration, invalid values mean no limit.
+func duration(value string) time.Duration {
+	d, _ := time.ParseDuration(value)
+	return d
+}
+
+func (r Remote) KeepAliveInterval() time.Duration {
+	return duration(r.KeepAlive)
+}
+
+// BandwidthBytes is the validated BandwidthLimit in bytes per second.
+func (r Remote) BandwidthBytes() int64 {
+	n, _ := byteSize(r.BandwidthLimit)
+	return n
+}
+
+// UploadPerm is the validated UploadMode, 0 when the local permissions are
+// kept.
+func (r Remote) UploadPerm() os.FileMode {
+	perm, _ := fileMode(r.UploadMode)
+	return perm
+}
+
+// fileMode parses octal permissions like 0640.
+func fileMode(value string) (os.FileMode, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || n == 0 || n > 0777 {
+		return 0, fmt.Errorf("%q is not an octal mode like 0640", value)
+	}
+	return os.FileMode(n), nil
+}
+
+// byteSize parses a number of bytes like 512K or 10M.
+func byteSize(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, nil
+	}
+	unit := int64(1)
+	switch value[len(value)-1] {
+	case 'k', 'K':
+		unit = 1 << 10
+	case 'm', 'M':
+		unit = 1 << 20
+	case 'g', 'G':
+		unit = 1 << 30
+	}
+	if unit > 1 {
+		value = value[:len(value)-1]
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%q is not a size like 512K or 10M", value)
+	}
+	return n * unit, nil
+}
+
+// SetRunID derives the names of the run files from the run id.
+func (c *Config) SetRunID(timestamp string) {
+	c.Files = Files{
+		Timestamp:       timestamp,
+		RemoteDbLogFile: "remote_changelog" + timestamp + ".sql",
+		LocalDbLogFile:  "local_changelog" + timestamp + ".sql",
+		LocalProjectDir: timestamp + "/",
+		SqlFile:         "UPDATE_" + timestamp + ".sql",
+
+		LiquibaseDefaults: "liquibase_" + timestamp + ".properties",
+	}
+}
+
+// Load applies the configuration file over c: first its defaults section,
+// then the given profile. Only the keys present in the file are changed.
+//
+//	defaults:
+//	  git:
+//	    repo-url: git.name.pl/name1/name2
+//	profiles:
+//	  prod:
+//	    remote:
+//	      addr: 10.0.0.1
+func Load(path, profile string, c *Config) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("cannot read config file: %v", err)
+	}
+	file := struct {
+		Defaults interface{}            `yaml:"defaults"`
+		Profiles map[string]interface{} `yaml:"profiles"`
+	}{}
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return fmt.Errorf("invalid config file %s: %v", path, err)
+	}
+	sections := []interface{}{file.Defaults}
+	if profile != "" {
+		settings, ok := file.Profiles[profile]
+		if !ok {
+			return fmt.Errorf("profile %q not found in %s", profile, path)
+		}
+		sections = append(sections, settings)
+	}
+	for _, section := range sections {
+		if section == nil {
+			continue
+		}
+		out, err := yaml.Marshal(section)
+		if err != nil {
+			return err
+		}
+		if err := yaml.UnmarshalStrict(out, c); err != nil {
+			return fmt.Errorf("invalid config file %s: %v", path, err)
+		}
+	}
+	return nil
+}
+
+type secretField struct {
+	name  string
+	value *string
+}
+
+// secrets returns the fields that may hold a secret reference.
+func (c *Config) secrets() []secretField {
+	fields := []secretField{
+		{"remote.password", &c.Remote.Password},
+		{"remote.wildfly-password", &c.Remote.WildflyPassword},
+		{"remote.key-passphrase", &c.Remote.KeyPassphrase},
+		{"remote-db.password", &c.RemoteDB.Password},
+		{"local-db.password", &c.LocalDB.Password},
+		{"git.password", &c.Git.Password},
+	}
+	for i := range c.Remote.JumpHosts {
+		jump := &c.Remote.JumpHosts[i]
+		name := fmt.Sprintf("remote.jump-hosts[%d]", i)
+		fields = append(fields, secretField{name + ".password", &jump.Password}, secretField{name + ".key-passphrase", &jump.KeyPassphrase})
+	}
+	return fields
+}
+
+// Secrets returns the resolved passwords, for masking them in output.
+func (c *Config) Secrets() []string {
+	var values []string
+	for _, field := range c.secrets() {
+		values = append(values, *field.value)
+	}
+	return values
+}
+
+// ResolveSecrets replaces the secret references (env:, file:, cmd:,
+// keystore:) of the password fields by their values. All failures are
+// reported together.
+func (c *Config) ResolveSecrets() error {
+	r := &secret.Resolver{Keystore: c.OpenKeystore}
+	v := &ValidationError{}
+	for _, field := range c.secrets() {
+		value, err := r.Resolve(*field.value)
+		if err != nil {
+			v.add("%s: %v", field.name, err)
+			continue
+		}
+		*field.value = value
+	}
+	if len(v.Problems) > 0 {
+		return v
+	}
+	return nil
+}
+
+// OpenKeystore decrypts the configured keystore.
+func (c *Config) OpenKeystore() (*secret.Keystore, error) {
+	if c.Keystore == "" {
+		return nil, fmt.Errorf("no keystore configured")
+	}
+	if !secret.IsReference(c.KeystorePassphrase) {
+		return nil, fmt.Errorf("keystore-passphrase must be an env:, file: or cmd: reference")
+	}
+	passphrase, err := (&secret.Resolver{}).Resolve(c.KeystorePassphrase)
+	if err != nil {
+		return nil, fmt.Errorf("keystore passphrase: %v", err)
+	}
+	return secret.OpenKeystore(c.Keystore, passphrase)
+}
+
+// ValidationError lists every problem found by Validate.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid configuration:\n  " + strings.Join(e.Problems, "\n  ")
+}
+
+// sections lists the settings each step of the tool needs, steps not listed
+// (e.g. local:<command>) need none.
+var sections = map[string][]string{
+	"local-changelog-backup":   {"local-db"},
+	"remote-changelog-dump":    {"remote", "remote-db"},
+	"remote-changelog-fetch":   {"remote"},
+	"remote-changelog-restore": {"local-db"},
+	"pull-project":             {"git"},
+	"sql-diff":                 {"git", "local-db", "liquibase"},
+	"local-changelog-restore":  {"local-db"},
+	"build-ear":                {"git"},
+	"package":                  {"git", "src-root"},
+	"upload":                   {"remote"},
+}
+
+// uses returns the settings needed by steps, all of them when steps is nil.
+func uses(steps []string) func(section string) bool {
+	used := map[string]bool{}
+	for _, step := range steps {
+		if strings.HasPrefix(step, "remote:") {
+			used["remote"] = true
+		}
+		for _, section := range sections[step] {
+			used[section] = true
+		}
+	}
+	return func(section string) bool {
+		return steps == nil || used[section]
+	}
+}
+
+// Validate checks the configuration and reports all problems at once. Values
+// that must be present are only required when one of steps uses them, nil
+// steps checks everything.
+func (c *Config) Validate(steps []string) error {
+	v := &ValidationError{}
+	use := uses(steps)
+	if use("remote") {
+		v.required("remote.addr", c.Remote.Addr)
+		v.port("remote.port", c.Remote.Port)
+		v.required("remote.user", c.Remote.User)
+	}
+	switch c.Remote.RunAsMethod {
+	case "su", "sudo", "sudo-password":
+	default:
+		v.add("remote.run-as-method: %q is not one of su, sudo, sudo-password", c.Remote.RunAsMethod)
+	}
+	switch c.Remote.HostKeyMode {
+	case "", "known-hosts", "tofu", "insecure":
+	case "fingerprint":
+		v.required("remote.host-key-fingerprint", c.Remote.HostKeyFingerprint)
+	default:
+		v.add("remote.host-key-mode: %q is not one of known-hosts, fingerprint, tofu, insecure", c.Remote.HostKeyMode)
+	}
+	for _, method := range c.Remote.AuthMethods {
+		switch method {
+		case "agent", "key", "password", "keyboard-interactive":
+		default:
+			v.add("remote.auth-methods: %q is not one of agent, key, password, keyboard-interactive", method)
+		}
+	}
+	for _, file := range c.Remote.IdentityFiles {
+		v.file("remote.identity-files", file)
+	}
+	for i, jump := range c.Remote.JumpHosts {
+		name := fmt.Sprintf("remote.jump-hosts[%d]", i)
+		v.required(name+".addr", jump.Addr)
+		if jump.Port != "" {
+			v.port(name+".port", jump.Port)
+		}
+		for _, file := range jump.IdentityFiles {
+			v.file(name+".identity-files", file)
+		}
+	}
+	if c.Remote.HostKeyFingerprint != "" && !strings.HasPrefix(c.Remote.HostKeyFingerprint, "SHA256:") {
+		v.add("remote.host-key-fingerprint: %q is not a SHA256:... fingerprint", c.Remote.HostKeyFingerprint)
+	}
+	if use("remote-db") {
+		v.database("remote-db", c.RemoteDB)
+	}
+	if use("local-db") {
+		v.database("local-db", c.LocalDB)
+	}
+	switch c.LocalDB.SSLMode {
+	case "", "disable", "require", "verify-ca", "verify-full":
+	default:
+		v.add("local-db.sslmode: %q is not one of disable, require, verify-ca, verify-full", c.LocalDB.SSLMode)
+	}
+	if use("git") && v.required("git.repo-url", c.Git.RepoURL) {
+		u, err := url.Parse("https://" + c.Git.RepoURL)
+		if err != nil || u.Host == "" || strings.Trim(u.Path, "/") == "" || strings.Contains(c.Git.RepoURL, "://") {
+			v.add("git.repo-url: %q is not a repository url without scheme, e.g. git.name.pl/group/project", c.Git.RepoURL)
+		}
+	}
+	if use("git") {
+		v.required("git.branch", c.Git.Branch)
+		v.required("git.user", c.Git.User)
+	}
+	if use("liquibase") {
+		v.file("liquibase.path", c.Liquibase.Path)
+		v.file("liquibase.db-driver", c.Liquibase.DriverJar)
+		v.required("liquibase.context", c.Liquibase.Context)
+	}
+	if use("src-root") {
+		v.required("liquibase.src-root", c.Liquibase.SrcRoot)
+	}
+	switch c.Remote.Transfer {
+	case "auto", "sftp", "scp":
+	default:
+		v.add("remote.transfer: %q is not one of auto, sftp, scp", c.Remote.Transfer)
+	}
+	v.duration("remote.keepalive", c.Remote.KeepAlive)
+	if c.Remote.KeepAliveCountMax < 1 {
+		v.add("remote.keepalive-count-max: %d must be at least 1", c.Remote.KeepAliveCountMax)
+	}
+	if c.Remote.ReconnectAttempts < 0 {
+		v.add("remote.reconnect-attempts: %d must not be negative", c.Remote.ReconnectAttempts)
+	}
+	if _, err := byteSize(c.Remote.BandwidthLimit); err != nil {
+		v.add("remote.bandwidth-limit: %q is not a size like 512K or 10M", c.Remote.BandwidthLimit)
+	}
+	if _, err := fileMode(c.Remote.UploadMode); err != nil {
+		v.add("remote.upload-mode: %q is not an octal mode like 0640", c.Remote.UploadMode)
+	}
+	v.duration("timeouts.step", c.Timeouts.Step)
+	v.duration("timeouts.command", c.Timeouts.Command)
+	for name, d := range c.Timeouts.Steps {
+		v.duration("timeouts.steps."+name, d)
+	}
+	if c.Dir != "" {
+		if !strings.HasSuffix(c.Dir, "/") {
+			v.add("dir: %q must end with /", c.Dir)
+		}
+		if info, err := os.Stat(c.Dir); err != nil || !info.IsDir() {
+			v.add("dir: %q is not an existing directory", c.Dir)
+		}
+	}
+	if len(v.Problems) > 0 {
+		return v
+	}
+	return nil
+}
+
+func (v *ValidationError) add(format string, args ...interface{}) {
+	v.Problems = append(v.Problems, fmt.Sprintf(format, args...))
+}
+
+func (v *ValidationError) required(name, value string) bool {
+	if strings.TrimSpace(value) == "" {
+		v.add("%s: missing", name)
+		return false
+	}
+	return true
+}
+
+func (v *ValidationError) port(name, value string) {
+	if !v.required(name, value) {
+		return
+	}
+	if port, err := strconv.Atoi(value); err != nil || port < 1 || port > 65535 {
+		v.add("%s: %q is not a port number", name, value)
+	}
+}
+
+func (v *ValidationError) file(name, path string) {
+	if !v.required(name, path) {
+		return
+	}
+	if info, err := os.Stat(path); err != nil || info.IsDir() {
+		v.add("%s: file %q not found", name, path)
+	}
+}
+
+func (v *ValidationError) duration(name, value string) {
+	if value == "" {
+		return
+	}
+	if d, err := time.ParseDuration(value); err != nil || d < 0 {
+		v.add("%s: %q is not a duration like 90s or 10m", name, value)
+	}
+}
+
+func (v *ValidationError) database(section string, db Database) {
+	v.required(section+".name", db.Name)
+	v.required(section+".schema", db.Schema)
+	v.required(section+".user", db.User)
+	v.required(section+".url", db.URL)
+	v.port(section+".port", db.Port)
+}
@@ -0,0 +1,173 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeConfig writes content to a config file in a temporary directory.
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "deploy.yml")
+	if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+const profiles = `
+defaults:
+  version: "1.0"
+  remote:
+    addr: 10.0.0.1
+    port: "2222"
+  git:
+    branch: develop
+profiles:
+  prod:
+    version: "2.0"
+    remote:
+      addr: 10.0.0.2
+  test:
+    git:
+      branch: test
+`
+
+func TestLoadProfileOverDefaults(t *testing.T) {
+	file := writeConfig(t, profiles)
+	defer os.RemoveAll(filepath.Dir(file))
+
+	tests := []struct {
+		profile string
+		version string
+		addr    string
+		port    string
+		branch  string
+	}{
+		{"", "1.0", "10.0.0.1", "2222", "develop"},
+		{"prod", "2.0", "10.0.0.2", "2222", "develop"},
+		{"test", "1.0", "10.0.0.1", "2222", "test"},
+	}
+	for _, tt := range tests {
+		t.Run("profile "+tt.profile, func(t *testing.T) {
+			c := Default()
+			if err := Load(file, tt.profile, c); err != nil {
+				t.Fatal(err)
+			}
+			if c.Version != tt.version || c.Remote.Addr != tt.addr || c.Remote.Port != tt.port || c.Git.Branch != tt.branch {
+				t.Errorf("version %q, addr %q, port %q, branch %q; want %q, %q, %q, %q",
+					c.Version, c.Remote.Addr, c.Remote.Port, c.Git.Branch, tt.version, tt.addr, tt.port, tt.branch)
+			}
+			// keys missing from the file keep their value
+			if c.Remote.User != "wildfly" || c.LocalDB.Port != "5432" {
+				t.Errorf("defaults overwritten: remote.user %q, local-db.port %q", c.Remote.User, c.LocalDB.Port)
+			}
+		})
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		profile string
+		want    string
+	}{
+		{"unknown top level key", "default:\n  version: x\n", "", "field default not found"},
+		{"unknown key in defaults", "defaults:\n  remote:\n    adress: x\n", "", "field adress not found"},
+		{"unknown key in profile", "profiles:\n  prod:\n    gti: {}\n", "prod", "field gti not found"},
+		{"run option", "defaults:\n  resume: \"1\"\n", "", "field resume not found"},
+		{"wrong type", "defaults:\n  remote:\n    keepalive-count-max: many\n", "", "invalid config file"},
+		{"missing profile", profiles, "stage", `profile "stage" not found`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := writeConfig(t, tt.content)
+			defer os.RemoveAll(filepath.Dir(file))
+			err := Load(file, tt.profile, Default())
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("err = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateSteps(t *testing.T) {
+	c := Default()
+	c.Remote.Addr = ""
+	c.LocalDB.Port = "0"
+	c.Git.Branch = ""
+	c.Liquibase.Path = ""
+
+	tests := []struct {
+		steps []string
+		want  []string
+		not   []string
+	}{
+		{nil, []string{"remote.addr", "local-db.port", "git.branch", "liquibase.path"}, nil},
+		{[]string{"upload"}, []string{"remote.addr"}, []string{"local-db.port", "git.branch", "liquibase.path"}},
+		{[]string{"remote:uptime"}, []string{"remote.addr"}, []string{"local-db.port"}},
+		{[]string{"local-changelog-backup"}, []string{"local-db.port"}, []string{"remote.addr", "git.branch"}},
+		{[]string{"pull-project", "package"}, []string{"git.branch"}, []string{"remote.addr", "liquibase.path"}},
+		{[]string{"sql-diff"}, []string{"local-db.port", "git.branch", "liquibase.path"}, []string{"remote.addr"}},
+		{[]string{"local:make", "clean"}, nil, []string{"remote.addr", "local-db.port", "git.branch", "liquibase.path"}},
+	}
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.steps, ","), func(t *testing.T) {
+			err := c.Validate(tt.steps)
+			got := ""
+			if err != nil {
+				got = err.Error()
+			}
+			for _, name := range tt.want {
+				if !strings.Contains(got, name+":") {
+					t.Errorf("%s not reported in %q", name, got)
+				}
+			}
+			for _, name := range tt.not {
+				if strings.Contains(got, name+":") {
+					t.Errorf("%s reported in %q", name, got)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateValues(t *testing.T) {
+	tests := []struct {
+		name string
+		set  func(c *Config)
+		want string
+	}{
+		{"port", func(c *Config) { c.Remote.Port = "70000" }, `remote.port: "70000" is not a port number`},
+		{"run as", func(c *Config) { c.Remote.RunAsMethod = "doas" }, "remote.run-as-method"},
+		{"fingerprint", func(c *Config) { c.Remote.HostKeyMode = "fingerprint" }, "remote.host-key-fingerprint: missing"},
+		{"auth", func(c *Config) { c.Remote.AuthMethods = []string{"kerberos"} }, "remote.auth-methods"},
+		{"repo url", func(c *Config) { c.Git.RepoURL = "https://git.name.pl/a/b" }, "git.repo-url"},
+		{"transfer", func(c *Config) { c.Remote.Transfer = "rsync" }, "remote.transfer"},
+		{"bandwidth", func(c *Config) { c.Remote.BandwidthLimit = "fast" }, "remote.bandwidth-limit"},
+		{"upload mode", func(c *Config) { c.Remote.UploadMode = "0999" }, "remote.upload-mode"},
+		{"timeout", func(c *Config) { c.Timeouts.Steps = map[string]string{"upload": "1 hour"} }, "timeouts.steps.upload"},
+		{"dir", func(c *Config) { c.Dir = "/tmp" }, "dir: \"/tmp\" must end with /"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Default()
+			tt.set(c)
+			err := c.Validate(nil)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("err = %v, want %q", err, tt.want)
+			}
+		})
+	}
+	if err := Default().Validate([]string{"clean"}); err != nil {
+		t.Errorf("defaults: %v", err)
+	}
+}
@@ -0,0 +1,331 @@
+package pipeline
+
+import (
+	"../redact"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Step is a single named unit of a deployment run. Undo reverts whatever Run
+// changed and is called for completed steps when a later step fails. Both
+// should give up when ctx is done.
+type Step interface {
+	Name() string
+	Run(ctx context.Context) error
+	Undo(ctx context.Context) error
+}
+
+type funcStep struct {
+	name string
+	run  func(ctx context.Context) error
+	undo func(ctx context.Context) error
+}
+
+// NewStep builds a Step from plain functions. undo may be nil for steps that
+// have nothing to revert.
+func NewStep(name string, run, undo func(ctx context.Context) error) Step {
+	return &funcStep{name: name, run: run, undo: undo}
+}
+
+func (s *funcStep) Name() string {
+	return s.name
+}
+
+func (s *funcStep) Run(ctx context.Context) error {
+	return s.run(ctx)
+}
+
+func (s *funcStep) Undo(ctx context.Context) error {
+	if s.undo == nil {
+		return nil
+	}
+	return s.undo(ctx)
+}
+
+// ArtifactStep is implemented by steps that produce files worth recording in
+// the run state. Remote reports whether the files are on the remote host.
+type ArtifactStep interface {
+	Step
+	Artifacts() []string
+	Remote() bool
+}
+
+type artifactStep struct {
+	Step
+	artifacts []string
+	remote    bool
+}
+
+// WithArtifacts attaches the paths of the local files produced by s.
+func WithArtifacts(s Step, artifacts ...string) Step {
+	return &artifactStep{Step: s, artifacts: artifacts}
+}
+
+// WithRemoteArtifacts attaches the paths of the files s produces on the
+// remote host.
+func WithRemoteArtifacts(s Step, artifacts ...string) Step {
+	return &artifactStep{Step: s, artifacts: artifacts, remote: true}
+}
+
+func (s *artifactStep) Artifacts() []string {
+	return s.artifacts
+}
+
+func (s *artifactStep) Remote() bool {
+	return s.remote
+}
+
+type permanentStep struct {
+	Step
+}
+
+// Permanent marks s as done for good once it finished: a rollback leaves it
+// finished and -resume does not repeat it, e.g. a command whose effects
+// cannot be undone.
+func Permanent(s Step) Step {
+	return &permanentStep{Step: s}
+}
+
+// digests collects the checksums reported by the running step.
+type digests struct {
+	mu    sync.Mutex
+	files map[string]string
+}
+
+type digestsKey struct{}
+
+// RecordDigest notes the SHA-256 digest of a file transferred by the step
+// running with ctx, it is kept with the step in the run state.
+func RecordDigest(ctx context.Context, file, sha256 string) {
+	d, ok := ctx.Value(digestsKey{}).(*digests)
+	if !ok {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.files == nil {
+		d.files = map[string]string{}
+	}
+	d.files[file] = sha256
+}
+
+// Registry holds every step known to the tool, addressable by name.
+type Registry struct {
+	steps map[string]Step
+	order []string
+}
+
+func NewRegistry() *Registry {
+	return &Registry{steps: map[string]Step{}}
+}
+
+// Add registers a step. Registration order is the default pipeline order.
+func (r *Registry) Add(s Step) {
+	if _, ok := r.steps[s.Name()]; !ok {
+		r.order = append(r.order, s.Name())
+	}
+	r.steps[s.Name()] = s
+}
+
+func (r *Registry) Get(name string) (Step, bool) {
+	s, ok := r.steps[name]
+	return s, ok
+}
+
+// Names returns registered step names in registration order.
+func (r *Registry) Names() []string {
+	return append([]string(nil), r.order...)
+}
+
+// Pipeline is an ordered list of steps. When State is set, finished steps are
+// checkpointed to it and steps already finished there are skipped once Check
+// accepts what they left.
+type Pipeline struct {
+	Steps []Step
+	State *State
+	// Check, when set, verifies that the artifacts and digests recorded for a
+	// finished step still hold before it is skipped. A step failing it runs
+	// again, and so do the steps after it.
+	Check func(ctx context.Context, f StepState) error
+	// Timeout limits every step, Timeouts overrides it per step name. Zero
+	// means no limit.
+	Timeout  time.Duration
+	Timeouts map[string]time.Duration
+}
+
+func New(steps ...Step) *Pipeline {
+	return &Pipeline{Steps: steps}
+}
+
+// Build assembles a pipeline from step names, leaving out the skipped ones.
+// Unknown names are reported together.
+func (r *Registry) Build(names, skip []string) (*Pipeline, error) {
+	skipped := map[string]bool{}
+	for _, name := range skip {
+		skipped[name] = true
+	}
+	var unknown []string
+	for _, name := range append(append([]string(nil), names...), skip...) {
+		if _, ok := r.steps[name]; !ok {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		return nil, fmt.Errorf("unknown steps: %s (available: %s)",
+			strings.Join(unknown, ", "), strings.Join(r.order, ", "))
+	}
+	p := New()
+	for _, name := range names {
+		if !skipped[name] {
+			p.Steps = append(p.Steps, r.steps[name])
+		}
+	}
+	return p, nil
+}
+
+// Names returns the names of the pipeline steps in order.
+func (p *Pipeline) Names() []string {
+	var names []string
+	for _, s := range p.Steps {
+		names = append(names, s.Name())
+	}
+	return names
+}
+
+// TimeoutOf returns the time limit of the named step.
+func (p *Pipeline) TimeoutOf(name string) time.Duration {
+	if t, ok := p.Timeouts[name]; ok {
+		return t
+	}
+	return p.Timeout
+}
+
+// Run executes steps in order. When a step fails, times out or ctx is
+// cancelled, the steps completed by this run are undone in reverse order and
+// the original error is returned; steps finished by an earlier run are kept,
+// as are the steps whose artifacts are checkpointed in State.
+func (p *Pipeline) Run(ctx context.Context) error {
+	var done []Step
+	stale := false
+	for _, s := range p.Steps {
+		if !stale && p.State != nil && p.State.IsFinished(s.Name()) {
+			err := p.check(ctx, s)
+			if err == nil {
+				redact.Println("Step " + s.Name() + " already finished, skipping")
+				continue
+			}
+			redact.Println("Step " + s.Name() + " has to run again: " + err.Error())
+			stale = true
+		}
+		if p.State != nil {
+			p.State.unfinish(s.Name())
+		}
+		if err := ctx.Err(); err != nil {
+			redact.Println("Cancelled before step " + s.Name())
+			p.rollback(done)
+			return err
+		}
+		redact.Println("Step " + s.Name() + "...")
+		d := &digests{}
+		if err := p.call(context.WithValue(ctx, digestsKey{}, d), s, s.Run); err != nil {
+			err = fmt.Errorf("step %s failed: %w", s.Name(), err)
+			redact.Println(err.Error())
+			p.rollback(done)
+			return err
+		}
+		done = append(done, s)
+		if err := p.checkpoint(s, d.files); err != nil {
+			return err
+		}
+		redact.Println("Step " + s.Name() + " completed")
+	}
+	if p.State != nil {
+		p.State.Done = true
+		return p.State.Save()
+	}
+	return nil
+}
+
+func (p *Pipeline) checkpoint(s Step, digests map[string]string) error {
+	if p.State == nil {
+		return nil
+	}
+	f := StepState{Name: s.Name(), Digests: digests}
+	if a, ok := s.(ArtifactStep); ok {
+		f.Artifacts, f.Remote = a.Artifacts(), a.Remote()
+	}
+	p.State.finish(f)
+	return p.State.Save()
+}
+
+// check runs Check on what the earlier run recorded for s.
+func (p *Pipeline) check(ctx context.Context, s Step) error {
+	f, ok := p.State.step(s.Name())
+	if !ok || p.Check == nil {
+		return nil
+	}
+	return p.call(ctx, s, func(ctx context.Context) error {
+		return p.Check(ctx, f)
+	})
+}
+
+// rollback undoes the steps even when the run was cancelled, each undo gets a
+// fresh context limited by the step timeout. With a State, steps that produced
+// artifacts stay finished with their files so -resume does not repeat them.
+func (p *Pipeline) rollback(done []Step) {
+	for i := len(done) - 1; i >= 0; i-- {
+		s := done[i]
+		if p.keeps(s) {
+			redact.Println("Keeping " + s.Name() + " for resume")
+			continue
+		}
+		redact.Println("Undo " + s.Name() + "...")
+		if err := p.call(context.Background(), s, s.Undo); err != nil {
+			redact.Println("Undo " + s.Name() + " failed: " + err.Error())
+			continue
+		}
+		if p.State != nil {
+			p.State.unfinish(s.Name())
+		}
+	}
+	if p.State != nil {
+		if err := p.State.Save(); err != nil {
+			redact.Println(err.Error())
+		}
+	}
+}
+
+// keeps reports whether a rollback leaves s finished: its artifacts are
+// recorded in the checkpoint or it is permanent.
+func (p *Pipeline) keeps(s Step) bool {
+	if p.State == nil {
+		return false
+	}
+	if _, ok := s.(*permanentStep); ok {
+		return true
+	}
+	a, ok := s.(ArtifactStep)
+	return ok && len(a.Artifacts()) > 0
+}
+
+// call runs f within the step timeout. A panicking step fails like one
+// returning an error.
+func (p *Pipeline) call(ctx context.Context, s Step, f func(ctx context.Context) error) (err error) {
+	if t := p.TimeoutOf(s.Name()); t > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t)
+		defer cancel()
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+		if err != nil && ctx.Err() == context.DeadlineExceeded {
+			err = fmt.Errorf("timed out after %v: %w", p.TimeoutOf(s.Name()), err)
+		}
+	}()
+	return f(ctx)
+}
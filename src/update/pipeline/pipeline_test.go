@@ -0,0 +1,212 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// run is a test deployment: artifact writes a file, restore has an undo,
+// notify is permanent and deploy fails while failing is set.
+type run struct {
+	dir     string
+	calls   []string
+	failing bool
+}
+
+func (r *run) record(call string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		r.calls = append(r.calls, call)
+		return nil
+	}
+}
+
+func (r *run) artifact() string {
+	return filepath.Join(r.dir, "app.ear")
+}
+
+func (r *run) pipeline(state *State) *Pipeline {
+	build := func(ctx context.Context) error {
+		r.calls = append(r.calls, "build")
+		return ioutil.WriteFile(r.artifact(), []byte("ear"), 0600)
+	}
+	deploy := func(ctx context.Context) error {
+		r.calls = append(r.calls, "deploy")
+		if r.failing {
+			return errors.New("deploy failed")
+		}
+		return nil
+	}
+	p := New(
+		WithArtifacts(NewStep("build", build, r.record("undo build")), r.artifact()),
+		NewStep("restore", r.record("restore"), r.record("undo restore")),
+		Permanent(NewStep("notify", r.record("notify"), nil)),
+		NewStep("deploy", deploy, nil),
+	)
+	p.State = state
+	p.Check = func(ctx context.Context, f StepState) error {
+		for _, file := range f.Artifacts {
+			if _, err := os.Stat(file); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return p
+}
+
+// failedRun runs the deployment with a failing deploy step and returns the
+// path of its checkpoint.
+func failedRun(t *testing.T, r *run) string {
+	t.Helper()
+	stateFile := StateFile(r.dir+"/", "1")
+	r.failing = true
+	if err := r.pipeline(NewState(stateFile, "1", nil)).Run(context.Background()); err == nil {
+		t.Fatal("run with a failing step succeeded")
+	}
+	want := []string{"build", "restore", "notify", "deploy", "undo restore"}
+	if !reflect.DeepEqual(r.calls, want) {
+		t.Fatalf("calls %q, want %q", r.calls, want)
+	}
+	r.calls, r.failing = nil, false
+	return stateFile
+}
+
+func tempRun(t *testing.T) *run {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "pipeline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &run{dir: dir}
+}
+
+func TestResume(t *testing.T) {
+	r := tempRun(t)
+	defer os.RemoveAll(r.dir)
+	stateFile := failedRun(t, r)
+
+	state, err := LoadState(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, finished := range map[string]bool{"build": true, "restore": false, "notify": true, "deploy": false} {
+		if state.IsFinished(name) != finished {
+			t.Errorf("%s finished = %v after the failed run, want %v", name, !finished, finished)
+		}
+	}
+	if err := r.pipeline(state).Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"restore", "deploy"}; !reflect.DeepEqual(r.calls, want) {
+		t.Errorf("resumed calls %q, want %q", r.calls, want)
+	}
+	if state, err = LoadState(stateFile); err != nil {
+		t.Fatal(err)
+	}
+	if !state.Done || len(state.Finished) != 4 {
+		t.Errorf("state after the resumed run: done %v, finished %v", state.Done, state.Finished)
+	}
+}
+
+func TestResumeRunsStaleStepAgain(t *testing.T) {
+	r := tempRun(t)
+	defer os.RemoveAll(r.dir)
+	stateFile := failedRun(t, r)
+	if err := os.Remove(r.artifact()); err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := LoadState(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.pipeline(state).Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// the steps after the stale one may have used its files
+	if want := []string{"build", "restore", "notify", "deploy"}; !reflect.DeepEqual(r.calls, want) {
+		t.Errorf("resumed calls %q, want %q", r.calls, want)
+	}
+	if len(state.Finished) != 4 {
+		t.Errorf("finished %v, want every step once", state.Finished)
+	}
+}
+
+func TestResumeCheckError(t *testing.T) {
+	r := tempRun(t)
+	defer os.RemoveAll(r.dir)
+	stateFile := failedRun(t, r)
+
+	state, err := LoadState(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := r.pipeline(state)
+	var checked []string
+	p.Check = func(ctx context.Context, f StepState) error {
+		checked = append(checked, f.Name)
+		if f.Name == "notify" {
+			return fmt.Errorf("digest mismatch")
+		}
+		return nil
+	}
+	if err := p.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"build", "notify"}; !reflect.DeepEqual(checked, want) {
+		t.Errorf("checked %q, want %q", checked, want)
+	}
+	if want := []string{"restore", "notify", "deploy"}; !reflect.DeepEqual(r.calls, want) {
+		t.Errorf("resumed calls %q, want %q", r.calls, want)
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pipeline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stateFile := StateFile(dir+"/", "2")
+
+	upload := func(ctx context.Context) error {
+		RecordDigest(ctx, "/tmp/deploy/app.ear", "abc")
+		return nil
+	}
+	p := New(WithRemoteArtifacts(NewStep("upload", upload, nil), "/tmp/deploy"))
+	p.State = NewState(stateFile, "2", p.Names())
+	if err := p.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	state, err := LoadState(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Finished) != 1 {
+		t.Fatalf("finished %v", state.Finished)
+	}
+	f := state.Finished[0]
+	if f.Name != "upload" || !f.Remote || !reflect.DeepEqual(f.Artifacts, []string{"/tmp/deploy"}) ||
+		!reflect.DeepEqual(f.Digests, map[string]string{"/tmp/deploy/app.ear": "abc"}) {
+		t.Errorf("checkpoint %+v", f)
+	}
+}
+
+func TestRollbackWithoutState(t *testing.T) {
+	r := tempRun(t)
+	defer os.RemoveAll(r.dir)
+	r.failing = true
+	if err := r.pipeline(nil).Run(context.Background()); err == nil {
+		t.Fatal("run with a failing step succeeded")
+	}
+	want := []string{"build", "restore", "notify", "deploy", "undo restore", "undo build"}
+	if !reflect.DeepEqual(r.calls, want) {
+		t.Errorf("calls %q, want %q", r.calls, want)
+	}
+}
@@ -0,0 +1,95 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// State is the checkpoint of a run, persisted after every step so an
+// interrupted run can be resumed from the first unfinished step.
+type State struct {
+	RunID    string      `json:"runId"`
+	Steps    []string    `json:"steps"`
+	Finished []StepState `json:"finished"`
+	Done     bool        `json:"done"`
+
+	path string
+}
+
+// StepState records a finished step, the files it produced, on the remote
+// host when Remote is set, and the SHA-256 digests of the files it
+// transferred.
+type StepState struct {
+	Name      string            `json:"name"`
+	Artifacts []string          `json:"artifacts,omitempty"`
+	Remote    bool              `json:"remote,omitempty"`
+	Digests   map[string]string `json:"sha256,omitempty"`
+	At        time.Time         `json:"at"`
+}
+
+// StateFile returns the checkpoint path of a run inside dir.
+func StateFile(dir, runID string) string {
+	return dir + "deploy_run_" + runID + ".json"
+}
+
+// NewState creates an empty checkpoint stored at path.
+func NewState(path, runID string, steps []string) *State {
+	return &State{RunID: runID, Steps: steps, path: path}
+}
+
+// LoadState reads a checkpoint written by a previous run.
+func LoadState(path string) (*State, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read run state: %v", err)
+	}
+	state := &State{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("invalid run state %s: %v", path, err)
+	}
+	state.path = path
+	return state, nil
+}
+
+func (s *State) Save() error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("cannot write run state: %v", err)
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func (s *State) IsFinished(name string) bool {
+	_, ok := s.step(name)
+	return ok
+}
+
+func (s *State) step(name string) (StepState, bool) {
+	for _, f := range s.Finished {
+		if f.Name == name {
+			return f, true
+		}
+	}
+	return StepState{}, false
+}
+
+func (s *State) finish(f StepState) {
+	f.At = time.Now()
+	s.Finished = append(s.Finished, f)
+}
+
+func (s *State) unfinish(name string) {
+	for i, f := range s.Finished {
+		if f.Name == name {
+			s.Finished = append(s.Finished[:i], s.Finished[i+1:]...)
+			return
+		}
+	}
+}
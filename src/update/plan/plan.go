@@ -0,0 +1,113 @@
+package plan
+
+import (
+	"../sshConnection"
+	"fmt"
+	"io"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// Plan collects everything a run would do instead of doing it.
+type Plan struct {
+	step    string
+	entries []Entry
+}
+
+// Entry is a single planned action of a step.
+type Entry struct {
+	Step string
+	Kind string
+	Dir  string
+	Line string
+}
+
+var credentials = []*regexp.Regexp{
+	regexp.MustCompile(`(://[^:/@\s]+:)[^@\s]+(@)`),
+	regexp.MustCompile(`(--password=)\S*()`),
+}
+
+func New() *Plan {
+	return &Plan{}
+}
+
+// Step starts collecting entries for the named step.
+func (p *Plan) Step(name string) {
+	p.step = name
+}
+
+// Local records a local command.
+func (p *Plan) Local(cmd *exec.Cmd) {
+	p.add("local", cmd.Dir, strings.Join(cmd.Args, " "))
+}
+
+// File records a local file system operation.
+func (p *Plan) File(line string) {
+	p.add("local", "", line)
+}
+
+// Remote records a command sent to host.
+func (p *Plan) Remote(host string, cmd sshConnection.Command) {
+	line := cmd.Line()
+	if cmd.Secret {
+		line = "<secret>"
+	}
+	p.add("remote "+host, "", line)
+}
+
+// Database records an operation on the named database.
+func (p *Plan) Database(name, line string) {
+	p.add("db "+name, "", line)
+}
+
+// Transfer records a file copy between hosts.
+func (p *Plan) Transfer(from, to string) {
+	p.add("scp", "", from+" -> "+to)
+}
+
+func (p *Plan) add(kind, dir, line string) {
+	for _, re := range credentials {
+		line = re.ReplaceAllString(line, "${1}***${2}")
+	}
+	p.entries = append(p.entries, Entry{Step: p.step, Kind: kind, Dir: dir, Line: line})
+}
+
+func (p *Plan) Entries() []Entry {
+	return p.entries
+}
+
+// Print writes the plan grouped by step.
+func (p *Plan) Print(w io.Writer) {
+	step := ""
+	for i, e := range p.entries {
+		if i == 0 || e.Step != step {
+			step = e.Step
+			fmt.Fprintln(w, "["+step+"]")
+		}
+		if e.Dir != "" {
+			fmt.Fprintf(w, "  %s (in %s): %s\n", e.Kind, e.Dir, e.Line)
+		} else {
+			fmt.Fprintf(w, "  %s: %s\n", e.Kind, e.Line)
+		}
+	}
+}
+
+// Connection is a sshConnection.ConnectionInt that only records commands.
+type Connection struct {
+	Plan *Plan
+	Host string
+}
+
+func (c *Connection) Execute(cmd sshConnection.Command) sshConnection.Result {
+	c.Plan.Remote(c.Host, cmd)
+	return sshConnection.Result{}
+}
+
+func (c *Connection) IsSuccess() bool {
+	return true
+}
+
+func (c *Connection) Valid() error {
+	return nil
+}
@@ -0,0 +1,65 @@
+package process
+
+import (
+	"context"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// running holds the commands started by Run that have not ended.
+var running = struct {
+	sync.Mutex
+	cmds map[*exec.Cmd]bool
+}{cmds: map[*exec.Cmd]bool{}}
+
+// Run starts cmd and waits for it. When ctx is done or timeout (if non zero)
+// passes first, the command and every process it started are killed and the
+// context error is returned.
+func Run(ctx context.Context, cmd *exec.Cmd, timeout time.Duration) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	setGroup(cmd)
+	running.Lock()
+	err := cmd.Start()
+	if err == nil {
+		running.cmds[cmd] = true
+	}
+	running.Unlock()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		running.Lock()
+		delete(running.cmds, cmd)
+		running.Unlock()
+	}()
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		killGroup(cmd)
+		<-done
+		return ctx.Err()
+	}
+}
+
+// KillAll kills every command started by Run that is still running, with the
+// processes it started. Used when the program has to exit at once.
+func KillAll() {
+	running.Lock()
+	defer running.Unlock()
+	for cmd := range running.cmds {
+		killGroup(cmd)
+	}
+}
@@ -0,0 +1,20 @@
+package process
+
+import (
+	"os/exec"
+	"strconv"
+)
+
+func setGroup(cmd *exec.Cmd) {
+}
+
+// killGroup kills the process tree with taskkill, Windows has no process
+// groups to signal.
+func killGroup(cmd *exec.Cmd) {
+	if cmd.Process == nil {
+		return
+	}
+	if err := exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(cmd.Process.Pid)).Run(); err != nil {
+		cmd.Process.Kill()
+	}
+}
@@ -0,0 +1,48 @@
+package progress
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Limiter keeps the transfers sharing it below a number of bytes per second.
+type Limiter struct {
+	rate float64
+	mu   sync.Mutex
+	// next is when the bytes taken so far are paid off.
+	next time.Time
+}
+
+// NewLimiter returns a Limiter of bytesPerSecond, nil when it is not positive.
+func NewLimiter(bytesPerSecond int64) *Limiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &Limiter{rate: float64(bytesPerSecond)}
+}
+
+// Wait accounts for n transferred bytes and sleeps until the rate allows more,
+// or ctx is done.
+func (l *Limiter) Wait(ctx context.Context, n int) error {
+	if l == nil || n <= 0 {
+		return nil
+	}
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(float64(n) / l.rate * float64(time.Second)))
+	wait := l.next.Sub(now)
+	l.mu.Unlock()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
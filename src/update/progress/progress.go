@@ -0,0 +1,200 @@
+package progress
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Interval is the time between two progress events of a transfer.
+var Interval = time.Second
+
+// Event is the state of one transfer.
+type Event struct {
+	Time time.Time `json:"time"`
+	// Name says what is transferred, e.g. "upload /tmp/deploy.tar.gz".
+	Name string `json:"name"`
+	// Bytes of Total are transferred, Total is 0 when unknown.
+	Bytes int64 `json:"bytes"`
+	Total int64 `json:"total,omitempty"`
+	// Rate is the average in bytes per second, ETA the expected time left.
+	Rate float64       `json:"rate"`
+	ETA  time.Duration `json:"eta,omitempty"`
+	Done bool          `json:"done,omitempty"`
+}
+
+// Sink receives the events of all transfers.
+type Sink interface {
+	Event(e Event)
+}
+
+// Console prints a progress line every Interval while a transfer runs.
+type Console struct {
+	W io.Writer
+}
+
+func (c Console) Event(e Event) {
+	if e.Done {
+		return
+	}
+	line := e.Name + ": " + Size(e.Bytes)
+	if e.Total > 0 {
+		line += fmt.Sprintf(" of %s (%d%%)", Size(e.Total), e.Bytes*100/e.Total)
+	}
+	line += ", " + Size(int64(e.Rate)) + "/s"
+	if eta := e.ETA.Round(time.Second); eta > 0 {
+		line += ", " + eta.String() + " left"
+	}
+	fmt.Fprintln(c.W, line)
+}
+
+// JSON writes every event, the final one with Done set, as a line of JSON.
+type JSON struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func NewJSON(w io.Writer) *JSON {
+	return &JSON{enc: json.NewEncoder(w)}
+}
+
+func (j *JSON) Event(e Event) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.enc.Encode(e)
+}
+
+// Sinks passes events to all its sinks.
+type Sinks []Sink
+
+func (s Sinks) Event(e Event) {
+	for _, sink := range s {
+		sink.Event(e)
+	}
+}
+
+// Size formats a byte count, e.g. 12.5 MiB.
+func Size(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+type key struct{}
+
+type settings struct {
+	sink  Sink
+	limit *Limiter
+}
+
+// With returns a context whose transfers report to sink and are slowed down
+// by limit, both may be nil.
+func With(ctx context.Context, sink Sink, limit *Limiter) context.Context {
+	return context.WithValue(ctx, key{}, settings{sink: sink, limit: limit})
+}
+
+// Reader wraps the source of a transfer of total bytes. Reading reports
+// progress and waits for the limiter of ctx. Without a sink or limiter in ctx
+// r is returned.
+func Reader(ctx context.Context, r io.Reader, name string, total int64) io.Reader {
+	t := newTracker(ctx, name, total)
+	if t == nil {
+		return r
+	}
+	return &reader{r: r, t: t}
+}
+
+// Writer wraps the destination of a transfer like Reader does the source.
+func Writer(ctx context.Context, w io.Writer, name string, total int64) io.Writer {
+	t := newTracker(ctx, name, total)
+	if t == nil {
+		return w
+	}
+	return &writer{w: w, t: t}
+}
+
+type reader struct {
+	r io.Reader
+	t *tracker
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if werr := r.t.add(n, err == io.EOF); werr != nil && err == nil {
+		err = werr
+	}
+	return n, err
+}
+
+type writer struct {
+	w io.Writer
+	t *tracker
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	if werr := w.t.add(n, false); werr != nil && err == nil {
+		err = werr
+	}
+	return n, err
+}
+
+// tracker counts the bytes of one transfer and emits its events.
+type tracker struct {
+	ctx   context.Context
+	s     settings
+	name  string
+	total int64
+	bytes int64
+	start time.Time
+	last  time.Time
+	done  bool
+}
+
+func newTracker(ctx context.Context, name string, total int64) *tracker {
+	s, _ := ctx.Value(key{}).(settings)
+	if s.sink == nil && s.limit == nil {
+		return nil
+	}
+	now := time.Now()
+	return &tracker{ctx: ctx, s: s, name: name, total: total, start: now, last: now}
+}
+
+// add counts n transferred bytes, eof marks the end of a source of unknown
+// size.
+func (t *tracker) add(n int, eof bool) error {
+	t.bytes += int64(n)
+	if s := t.s.sink; s != nil && !t.done {
+		now := time.Now()
+		t.done = eof || t.total > 0 && t.bytes >= t.total
+		if t.done || now.Sub(t.last) >= Interval {
+			t.last = now
+			s.Event(t.event(now))
+		}
+	}
+	if t.s.limit != nil {
+		return t.s.limit.Wait(t.ctx, n)
+	}
+	return nil
+}
+
+func (t *tracker) event(now time.Time) Event {
+	e := Event{Time: now, Name: t.name, Bytes: t.bytes, Total: t.total, Done: t.done}
+	if elapsed := now.Sub(t.start).Seconds(); elapsed > 0 {
+		e.Rate = float64(t.bytes) / elapsed
+	}
+	if e.Rate > 0 && t.total > t.bytes {
+		e.ETA = time.Duration(float64(t.total-t.bytes) / e.Rate * float64(time.Second))
+	}
+	return e
+}
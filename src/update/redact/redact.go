@@ -0,0 +1,109 @@
+package redact
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Mask replaces every secret in redacted output.
+const Mask = "******"
+
+var (
+	mu      sync.RWMutex
+	secrets []string
+)
+
+// Add registers secrets to be masked from now on. Empty values are ignored,
+// the url encoded and shell quoted forms are registered too since secrets end
+// up in urls and remote commands.
+func Add(values ...string) {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, value := range values {
+		if value == "" {
+			continue
+		}
+		// quoted like sshConnection.ShellQuote, which imports this package
+		escaped := strings.Replace(value, "'", `'\''`, -1)
+		forms := []string{value, url.QueryEscape(value), url.PathEscape(value), escaped, "'" + escaped + "'"}
+		for _, v := range forms {
+			if !contains(secrets, v) {
+				secrets = append(secrets, v)
+			}
+		}
+	}
+	// longest first, so a secret containing another one is masked whole
+	sort.Slice(secrets, func(i, j int) bool {
+		return len(secrets[i]) > len(secrets[j])
+	})
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns s with every registered secret masked.
+func String(s string) string {
+	mu.RLock()
+	defer mu.RUnlock()
+	for _, secret := range secrets {
+		s = strings.Replace(s, secret, Mask, -1)
+	}
+	return s
+}
+
+// Error returns err with every registered secret masked from its message.
+func Error(err error) error {
+	if err == nil {
+		return nil
+	}
+	if masked := String(err.Error()); masked != err.Error() {
+		return &maskedError{msg: masked, err: err}
+	}
+	return err
+}
+
+type maskedError struct {
+	msg string
+	err error
+}
+
+func (e *maskedError) Error() string {
+	return e.msg
+}
+
+func (e *maskedError) Unwrap() error {
+	return e.err
+}
+
+// Println is fmt.Println with secrets masked.
+func Println(a ...interface{}) {
+	fmt.Print(String(fmt.Sprintln(a...)))
+}
+
+// Printf is fmt.Printf with secrets masked.
+func Printf(format string, a ...interface{}) {
+	fmt.Print(String(fmt.Sprintf(format, a...)))
+}
+
+// Writer masks secrets in everything written to it. Every Write is masked on
+// its own, so it suits line oriented output like log.
+type Writer struct {
+	W io.Writer
+}
+
+func (w Writer) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(w.W, String(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,317 @@
+package scp
+
+import (
+	"../progress"
+	"../redact"
+	"../sshConnection"
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CopyDirToRemote copies the local directory localDir with all its files and
+// subdirectories to remoteDir, keeping their modes and modification times;
+// files get the permissions perm instead unless it is 0. The parent of
+// remoteDir has to exist, an existing remoteDir is merged into. Symbolic links
+// to files are followed, links to directories and special files are left out.
+// Files and directories the remote scp refuses are skipped and returned as
+// warnings, the error then lists them too.
+func CopyDirToRemote(ctx context.Context, c *sshConnection.Client, localDir, remoteDir string, perm os.FileMode) ([]string, error) {
+	info, err := os.Stat(localDir)
+	if err == nil && !info.IsDir() {
+		err = fmt.Errorf("%s is not a directory", localDir)
+	}
+	if err != nil {
+		return nil, &TransferError{Op: "write", Path: remoteDir, Err: err}
+	}
+	cmd := "scp -qrpt " + sshConnection.ShellQuote(path.Dir(remoteDir))
+	warnings, err := toSink(ctx, c, cmd, func(k *sink) error {
+		return sendDir(ctx, k, localDir, path.Base(remoteDir), info, perm)
+	})
+	if err != nil {
+		return warnings, &TransferError{Op: "write", Path: remoteDir, Err: err}
+	}
+	return warnings, nil
+}
+
+// sendDir sends the D record of dir, everything in it and the closing E
+// record. Files are sent with perm, or their own mode when it is 0.
+func sendDir(ctx context.Context, k *sink, dir, name string, info os.FileInfo, perm os.FileMode) error {
+	if ok, err := k.record(times(info)); !ok || err != nil {
+		return err
+	}
+	if ok, err := k.record(fmt.Sprintf("D%04o 0 %s", info.Mode().Perm(), name)); !ok || err != nil {
+		return err
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		p := filepath.Join(dir, entry.Name())
+		if entry.Mode()&os.ModeSymlink != 0 {
+			if entry, err = os.Stat(p); err != nil {
+				return err
+			}
+			if entry.IsDir() {
+				continue
+			}
+		}
+		switch {
+		case entry.IsDir():
+			err = sendDir(ctx, k, p, entry.Name(), entry, perm)
+		case entry.Mode().IsRegular():
+			err = sendFile(ctx, k, p, entry.Name(), entry, perm)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_, err = k.record("E")
+	return err
+}
+
+// sendFile sends the T and C records of file followed by its content.
+func sendFile(ctx context.Context, k *sink, file, name string, info os.FileInfo, perm os.FileMode) error {
+	if perm == 0 {
+		perm = info.Mode()
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if ok, err := k.record(times(info)); !ok || err != nil {
+		return err
+	}
+	_, err = k.file(progress.Reader(ctx, f, "upload "+file, info.Size()), name, perm, info.Size())
+	return err
+}
+
+// times is the T record, the access time is not kept and set to the
+// modification time.
+func times(info os.FileInfo) string {
+	mtime := info.ModTime().Unix()
+	return fmt.Sprintf("T%d 0 %d 0", mtime, mtime)
+}
+
+// CopyRemoteToLocal copies the remote file or directory remotePath to
+// localPath, directories with all their files and subdirectories. The parent
+// of localPath has to exist, an existing directory localPath is merged into.
+// Modes and modification times of the remote host are kept.
+func CopyRemoteToLocal(ctx context.Context, c *sshConnection.Client, remotePath, localPath string) error {
+	if err := receiveRecursive(ctx, c, remotePath, localPath); err != nil {
+		return &TransferError{Op: "read", Path: remotePath, Err: err}
+	}
+	return nil
+}
+
+func receiveRecursive(ctx context.Context, a *sshConnection.Client, remotePath, localPath string) (err error) {
+	s, err := a.NewSession(ctx)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	stop := sshConnection.Interrupt(ctx, s)
+	defer func() {
+		if stop() && err != nil {
+			err = ctx.Err()
+		}
+	}()
+	stdout, err := s.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stdin, err := s.StdinPipe()
+	if err != nil {
+		return err
+	}
+	rw := bufio.NewReadWriter(bufio.NewReader(stdout), bufio.NewWriter(stdin))
+	if err := s.Start("scp -qrpf " + sshConnection.ShellQuote(remotePath)); err != nil {
+		return err
+	}
+	warnings, err := receive(ctx, rw, filepath.Dir(localPath), filepath.Base(localPath))
+	if err != nil {
+		return err
+	}
+	stdin.Close()
+	if err := s.Wait(); err != nil {
+		if len(warnings) > 0 {
+			return fmt.Errorf("%w: %s", err, strings.Join(warnings, ", "))
+		}
+		return err
+	}
+	return nil
+}
+
+// receiving is a directory being received, its mode and times are set once
+// its E record came.
+type receiving struct {
+	path  string
+	mode  os.FileMode
+	mtime *time.Time
+}
+
+// receive handles the records sent by a remote scp -f and writes the files
+// below dir, the file or directory sent first is named name. It returns the
+// warnings of the sender, e.g. files it could not read.
+func receive(ctx context.Context, rw *bufio.ReadWriter, dir, name string) ([]string, error) {
+	dirs := []receiving{{path: dir}}
+	var mtime *time.Time
+	var warnings []string
+	if err := ack(rw); err != nil {
+		return nil, err
+	}
+	for {
+		b, err := rw.ReadByte()
+		if err == io.EOF {
+			if len(dirs) != 1 {
+				return warnings, io.ErrUnexpectedEOF
+			}
+			return warnings, nil
+		} else if err != nil {
+			return warnings, err
+		}
+		l, err := rw.ReadBytes('\n')
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return warnings, err
+		}
+		l = append([]byte{b}, bytes.TrimRight(l, "\n")...)
+
+		switch b {
+		case 0x01:
+			warnings = append(warnings, redact.String(string(l[1:])))
+			continue
+		case 0x02:
+			return warnings, fmt.Errorf("error: %q", redact.String(string(l[1:])))
+		case 'T':
+			t, err := parseTimes(l)
+			if err != nil {
+				return warnings, err
+			}
+			mtime = &t
+		case 'D':
+			mode, _, p, err := target(dirs, l, name)
+			if err != nil {
+				return warnings, err
+			}
+			// writable until its content is there, the mode is set on E
+			if err := os.Mkdir(p, 0700); err != nil && !os.IsExist(err) {
+				return warnings, err
+			}
+			dirs = append(dirs, receiving{path: p, mode: mode, mtime: mtime})
+			mtime = nil
+		case 'E':
+			if len(dirs) == 1 {
+				return warnings, errors.New("unexpected E record")
+			}
+			d := dirs[len(dirs)-1]
+			dirs = dirs[:len(dirs)-1]
+			if err := setAttributes(d.path, d.mode, d.mtime); err != nil {
+				return warnings, err
+			}
+		case 'C':
+			mode, size, p, err := target(dirs, l, name)
+			if err != nil {
+				return warnings, err
+			}
+			if err := ack(rw); err != nil {
+				return warnings, err
+			}
+			if err := receiveFile(ctx, rw, p, size); err != nil {
+				return warnings, err
+			}
+			if err := setAttributes(p, mode, mtime); err != nil {
+				return warnings, err
+			}
+			mtime = nil
+		default:
+			return warnings, fmt.Errorf("invalid record %q", l)
+		}
+		if err := ack(rw); err != nil {
+			return warnings, err
+		}
+	}
+}
+
+// target returns mode, size and local path of the C or D record l, received
+// in the innermost of dirs. The first record is named name.
+func target(dirs []receiving, l []byte, name string) (os.FileMode, int64, string, error) {
+	mode, size, recordName, err := parseRecord(l)
+	if err != nil {
+		return 0, 0, "", err
+	}
+	if len(dirs) > 1 || name == "" {
+		name = recordName
+	}
+	return mode, size, filepath.Join(dirs[len(dirs)-1].path, name), nil
+}
+
+// receiveFile writes the size bytes of content following a C record to file
+// and reads the status byte the sender ends it with.
+func receiveFile(ctx context.Context, r *bufio.ReadWriter, file string, size int64) error {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err := copyN(progress.Writer(ctx, f, "download "+file, size), r, size); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	b, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if b != 0 {
+		l, _ := r.ReadBytes('\n')
+		return fmt.Errorf("error: %q", redact.String(string(bytes.TrimRight(l, "\n"))))
+	}
+	return nil
+}
+
+func setAttributes(p string, mode os.FileMode, mtime *time.Time) error {
+	if err := os.Chmod(p, mode); err != nil {
+		return err
+	}
+	if mtime == nil {
+		return nil
+	}
+	return os.Chtimes(p, *mtime, *mtime)
+}
+
+func ack(w *bufio.ReadWriter) error {
+	if err := w.WriteByte(0); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// parseTimes reads the modification time of a T record,
+// T<mtime> 0 <atime> 0.
+func parseTimes(l []byte) (time.Time, error) {
+	bits := bytes.Fields(l[1:])
+	if len(bits) != 4 {
+		return time.Time{}, fmt.Errorf("invalid time record %q", l)
+	}
+	mtime, err := strconv.ParseInt(string(bits[0]), 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(mtime, 0), nil
+}
@@ -0,0 +1,270 @@
+package scp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// receiveFrom runs receive on the records a remote scp -f would send and
+// returns the acknowledgements written back.
+func receiveFrom(t *testing.T, records, dir, name string) ([]string, int, error) {
+	t.Helper()
+	var acks bytes.Buffer
+	rw := bufio.NewReadWriter(bufio.NewReader(strings.NewReader(records)), bufio.NewWriter(&acks))
+	warnings, err := receive(context.Background(), rw, dir, name)
+	return warnings, bytes.Count(acks.Bytes(), []byte{0}), err
+}
+
+func TestReceiveTree(t *testing.T) {
+	dir, err := ioutil.TempDir("", "receive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	records := "T1500000000 0 1500000000 0\n" +
+		"D0750 0 pkg\n" +
+		"T1400000000 0 1400000000 0\n" +
+		"C0640 5 app.ear\nhello\x00" +
+		"\x01scp: conf/secret: Permission denied\n" +
+		"D0700 0 conf\n" +
+		"C0600 0 empty\n\x00" +
+		"E\n" +
+		"E\n"
+	warnings, acks, err := receiveFrom(t, records, dir, "deploy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 1 || warnings[0] != "scp: conf/secret: Permission denied" {
+		t.Errorf("warnings = %q", warnings)
+	}
+	// one to start, one per record and one per file content, none for the
+	// warning
+	if acks != 11 {
+		t.Errorf("sent %d acknowledgements, want 11", acks)
+	}
+
+	tests := []struct {
+		path    string
+		mode    os.FileMode
+		content string
+		mtime   int64
+	}{
+		{"deploy", os.ModeDir | 0750, "", 1500000000},
+		{"deploy/app.ear", 0640, "hello", 1400000000},
+		{"deploy/conf", os.ModeDir | 0700, "", 0},
+		{"deploy/conf/empty", 0600, "", 0},
+	}
+	for _, tt := range tests {
+		p := filepath.Join(dir, filepath.FromSlash(tt.path))
+		info, err := os.Stat(p)
+		if err != nil {
+			t.Errorf("%s: %v", tt.path, err)
+			continue
+		}
+		if info.Mode() != tt.mode {
+			t.Errorf("%s: mode %v, want %v", tt.path, info.Mode(), tt.mode)
+		}
+		if tt.mtime != 0 && info.ModTime().Unix() != tt.mtime {
+			t.Errorf("%s: mtime %d, want %d", tt.path, info.ModTime().Unix(), tt.mtime)
+		}
+		if !info.IsDir() {
+			content, _ := ioutil.ReadFile(p)
+			if string(content) != tt.content {
+				t.Errorf("%s: content %q, want %q", tt.path, content, tt.content)
+			}
+		}
+	}
+}
+
+func TestReceiveSingleFileRenamed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "receive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, _, err := receiveFrom(t, "C0644 3 remote.sql\nsql\x00", dir, "local.sql"); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(dir, "local.sql"))
+	if err != nil || string(content) != "sql" {
+		t.Errorf("local.sql = %q, %v", content, err)
+	}
+}
+
+func TestReceiveErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		records string
+		want    string
+	}{
+		{"fatal", "\x02scp: /tmp/x: No such file or directory\n", "No such file or directory"},
+		{"fatal inside a directory", "D0755 0 d\n\x02scp: disk error\n", "disk error"},
+		{"unclosed directory", "D0755 0 d\n", io.ErrUnexpectedEOF.Error()},
+		{"unexpected end", "E\n", "unexpected E record"},
+		{"truncated record", "D0755 0 d", io.ErrUnexpectedEOF.Error()},
+		{"short content", "C0644 10 f\nabc", io.ErrUnexpectedEOF.Error()},
+		{"sender error after content", "C0644 3 f\nabc\x02read failed\n", "read failed"},
+		{"invalid record", "X\n", "invalid record"},
+		{"invalid time", "T1 2\n", "invalid time record"},
+		{"path in name", "C0644 1 ../f\nx\x00", "invalid"},
+		{"dot name", "D0755 0 ..\n", "invalid"},
+		{"negative size", "C0644 -1 f\n", "invalid file size"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "receive")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			_, _, err = receiveFrom(t, tt.records, dir, "")
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("err = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+// sinkWith returns a sink answering with answers and the buffer the records
+// are written to.
+func sinkWith(answers string) (*sink, *bytes.Buffer) {
+	var out bytes.Buffer
+	return &sink{w: bufio.NewWriter(&out), r: bufio.NewReader(strings.NewReader(answers))}, &out
+}
+
+// tree creates pkg/app.ear, pkg/conf/a.properties and a link to conf, which
+// sendDir leaves out, in a temporary directory.
+func tree(t *testing.T) (string, os.FileInfo) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "send")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkg := filepath.Join(dir, "pkg")
+	files := []struct {
+		path    string
+		content string
+		mode    os.FileMode
+		mtime   int64
+	}{
+		{"app.ear", "hello", 0640, 1400000000},
+		{"conf/a.properties", "", 0600, 1300000000},
+	}
+	if err := os.MkdirAll(filepath.Join(pkg, "conf"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		p := filepath.Join(pkg, filepath.FromSlash(f.path))
+		if err := ioutil.WriteFile(p, []byte(f.content), f.mode); err != nil {
+			t.Fatal(err)
+		}
+		os.Chmod(p, f.mode)
+		os.Chtimes(p, time.Unix(f.mtime, 0), time.Unix(f.mtime, 0))
+	}
+	os.Symlink(filepath.Join(pkg, "conf"), filepath.Join(pkg, "link-to-dir"))
+	os.Chmod(filepath.Join(pkg, "conf"), 0700)
+	os.Chtimes(filepath.Join(pkg, "conf"), time.Unix(1200000000, 0), time.Unix(1200000000, 0))
+	os.Chmod(pkg, 0750)
+	os.Chtimes(pkg, time.Unix(1500000000, 0), time.Unix(1500000000, 0))
+	info, err := os.Stat(pkg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pkg, info
+}
+
+func TestSendDir(t *testing.T) {
+	pkg, info := tree(t)
+	defer os.RemoveAll(filepath.Dir(pkg))
+
+	k, out := sinkWith(strings.Repeat("\x00", 12))
+	if err := sendDir(context.Background(), k, pkg, "deploy", info, 0); err != nil {
+		t.Fatal(err)
+	}
+	want := "T1500000000 0 1500000000 0\n" +
+		"D0750 0 deploy\n" +
+		"T1400000000 0 1400000000 0\n" +
+		"C0640 5 app.ear\nhello\x00" +
+		"T1200000000 0 1200000000 0\n" +
+		"D0700 0 conf\n" +
+		"T1300000000 0 1300000000 0\n" +
+		"C0600 0 a.properties\n\x00" +
+		"E\n" +
+		"E\n"
+	if out.String() != want {
+		t.Errorf("records\n%q\nwant\n%q", out.String(), want)
+	}
+	if len(k.warnings) > 0 {
+		t.Errorf("warnings = %q", k.warnings)
+	}
+}
+
+func TestSendDirPerm(t *testing.T) {
+	pkg, info := tree(t)
+	defer os.RemoveAll(filepath.Dir(pkg))
+
+	k, out := sinkWith(strings.Repeat("\x00", 12))
+	if err := sendDir(context.Background(), k, pkg, "deploy", info, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// files get perm, directories keep their modes
+	for _, record := range []string{"D0750 0 deploy\n", "C0644 5 app.ear\n", "D0700 0 conf\n", "C0644 0 a.properties\n"} {
+		if !strings.Contains(out.String(), record) {
+			t.Errorf("records %q lack %q", out.String(), record)
+		}
+	}
+}
+
+func TestSendDirWarningSkipsEntry(t *testing.T) {
+	pkg, info := tree(t)
+	defer os.RemoveAll(filepath.Dir(pkg))
+
+	// the remote scp refuses the conf directory
+	answers := "\x00\x00" + "\x00\x00\x00" + "\x00\x01scp: conf: Permission denied\n" + "\x00"
+	k, out := sinkWith(answers)
+	if err := sendDir(context.Background(), k, pkg, "deploy", info, 0); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), "a.properties") {
+		t.Errorf("content of the refused directory was sent: %q", out.String())
+	}
+	if !strings.HasSuffix(out.String(), "D0700 0 conf\nE\n") {
+		t.Errorf("records end with %q", out.String())
+	}
+	if len(k.warnings) != 1 || k.warnings[0] != "scp: conf: Permission denied" {
+		t.Errorf("warnings = %q", k.warnings)
+	}
+}
+
+func TestSendDirFatalError(t *testing.T) {
+	pkg, info := tree(t)
+	defer os.RemoveAll(filepath.Dir(pkg))
+
+	// the file content is refused
+	answers := "\x00\x00" + "\x00\x00" + "\x02scp: app.ear: No space left on device\n"
+	k, _ := sinkWith(answers)
+	err := sendDir(context.Background(), k, pkg, "deploy", info, 0)
+	if err == nil || !strings.Contains(err.Error(), "No space left on device") {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestSendDirRemoteGone(t *testing.T) {
+	pkg, info := tree(t)
+	defer os.RemoveAll(filepath.Dir(pkg))
+
+	k, _ := sinkWith("\x00")
+	if err := sendDir(context.Background(), k, pkg, "deploy", info, 0); err != io.ErrUnexpectedEOF {
+		t.Errorf("err = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
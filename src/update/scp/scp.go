@@ -3,16 +3,45 @@ package scp
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
+	"../progress"
 	"../sshConnection"
+	"../redact"
 	"path"
 )
 
+// ErrTransfer matches every *TransferError.
+var ErrTransfer = errors.New("file transfer failed")
+
+// TransferError is a failed copy from or to the remote host.
+type TransferError struct {
+	// Op is read or write.
+	Op   string
+	Path string
+	Err  error
+}
+
+func (e *TransferError) Error() string {
+	return "scp " + e.Op + " " + e.Path + ": " + e.Err.Error()
+}
+
+func (e *TransferError) Unwrap() error {
+	return e.Err
+}
+
+func (e *TransferError) Is(target error) bool {
+	return target == ErrTransfer
+}
+
 /*
  File struct and read method
  https://gowalker.org/github.com/deoxxa/scp
@@ -78,9 +107,23 @@ func (f File) Sys() interface{} {
 //
 // Errors that occur before the content is being read will be returned directly
 // from Read, while errors that occur during content reception will be returned
-// via the Reader (e.g. from Reader.Read).
-func Read(c *sshConnection.Client, file string) (*File, error) {
-	s := c.Session
+// via the Reader (e.g. from Reader.Read). Cancelling ctx aborts the transfer
+// at any point.
+func Read(ctx context.Context, c *sshConnection.Client, file string) (f *File, err error) {
+	s, err := c.NewSession(ctx)
+	if err != nil {
+		return nil, &TransferError{Op: "read", Path: file, Err: err}
+	}
+	stop := sshConnection.Interrupt(ctx, s)
+	defer func() {
+		if err != nil && stop() {
+			err = ctx.Err()
+		}
+		if err != nil {
+			s.Close()
+			err = &TransferError{Op: "read", Path: file, Err: err}
+		}
+	}()
 	stdout, err := s.StdoutPipe()
 	if err != nil {
 		return nil, err
@@ -121,7 +164,7 @@ func Read(c *sshConnection.Client, file string) (*File, error) {
 			0x02: "error",
 		}
 
-		return nil, fmt.Errorf("%s: %q", m[b], string(bytes.TrimRight(l, "\n")))
+		return nil, fmt.Errorf("%s: %q", m[b], redact.String(string(bytes.TrimRight(l, "\n"))))
 	}
 
 	if err := rw.UnreadByte(); err != nil {
@@ -153,7 +196,11 @@ func Read(c *sshConnection.Client, file string) (*File, error) {
 		var err error
 
 		defer func() {
+			if stop() && err != nil {
+				err = ctx.Err()
+			}
 			if err != nil {
+				err = &TransferError{Op: "read", Path: file, Err: err}
 				w.CloseWithError(err)
 			} else {
 				w.Close()
@@ -161,24 +208,8 @@ func Read(c *sshConnection.Client, file string) (*File, error) {
 		}()
 
 		err = func() error {
-			t := 0
-
-			for {
-				b := make([]byte, min(1024, int(size)-t))
-
-				n, err := stdout.Read(b)
-				if err == io.EOF {
-					break
-				} else if err != nil {
-					return err
-				}
-
-				w.Write(b[0:n])
-				t += n
-
-				if int64(t) == size {
-					break
-				}
+			if err := copyN(progress.Writer(ctx, w, "download "+file, size), rw, size); err != nil {
+				return err
 			}
 
 			if err := rw.WriteByte(0); err != nil {
@@ -201,40 +232,190 @@ func Read(c *sshConnection.Client, file string) (*File, error) {
 	return NewFile(name, size, mode, r), nil
 }
 
-// Write writes the given File to the directory specified. It returns a list of
-// warnings and maybe an error on failure. Warnings are non-fatal, errors are
-// fatal. If there are warnings returned, they're probably important.
-func CopyLocalToRemote(c *sshConnection.Client, localFile, remoteFile string) {
+// CopyLocalToRemote copies localFile to remoteFile with the permissions perm,
+// 0 keeps those of localFile. It returns the warnings of the remote scp and an
+// error, carrying the warnings too, when the copy failed. Warnings are
+// non-fatal, errors are fatal. If there are warnings returned, they're
+// probably important.
+func CopyLocalToRemote(ctx context.Context, c *sshConnection.Client, localFile, remoteFile string, perm os.FileMode) ([]string, error) {
+	warnings, err := copy(ctx, c, localFile, remoteFile, perm)
+	if err != nil {
+		return warnings, &TransferError{Op: "write", Path: remoteFile, Err: err}
+	}
+	return warnings, nil
+}
+
+// Copies the contents of a local file to a remote location
+func copy(ctx context.Context, a *sshConnection.Client, localFile, remotePath string, perm os.FileMode) ([]string, error) {
 	file, err := os.Open(localFile)
 	if err != nil {
-		panic("Canot open local file" + err.Error())
+		return nil, err
 	}
 	defer file.Close()
-	err = copy(c, *file, remoteFile, "0777")
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if perm == 0 {
+		perm = stat.Mode()
+	}
+
+	size := stat.Size()
+	r := progress.Reader(ctx, file, "upload "+remotePath, size)
+	return toSink(ctx, a, "scp -qt "+sshConnection.ShellQuote(path.Dir(remotePath)), func(k *sink) error {
+		_, err := k.file(r, path.Base(remotePath), perm, size)
+		return err
+	})
 }
 
+// toSink starts the remote scp -t command and has send write the records to
+// it. The warnings sent back by the remote scp are returned, an error ends
+// the copy.
+func toSink(ctx context.Context, a *sshConnection.Client, cmd string, send func(k *sink) error) ([]string, error) {
+	s, err := a.NewSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	w, err := s.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	r, err := s.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stop := sshConnection.Interrupt(ctx, s)
+	if err := s.Start(cmd); err != nil {
+		stop()
+		return nil, err
+	}
 
-// Copies the contents of an io.Reader to a remote location
-func copy(a *sshConnection.Client, file os.File, remotePath string, permissions string) error {
-	stat, _ := file.Stat()
+	k := &sink{w: bufio.NewWriter(w), r: bufio.NewReader(r)}
+	// the remote scp is ready once it sent the first acknowledgement
+	_, err = k.ack()
+	if err == nil {
+		err = send(k)
+	}
+	w.Close()
+	if werr := s.Wait(); err == nil {
+		err = werr
+	}
+	if stop() {
+		return k.warnings, ctx.Err()
+	}
+	if err != nil && len(k.warnings) > 0 {
+		err = fmt.Errorf("%w: %s", err, strings.Join(k.warnings, ", "))
+	}
+	return k.warnings, err
+}
 
-	size := stat.Size()
-	filename := path.Base(remotePath)
-	directory := path.Dir(remotePath)
-	r := io.Reader(&file)
-	go func() {
-		w, _ := a.Session.StdinPipe()
-		defer w.Close()
-		fmt.Fprintln(w, "C"+permissions, size, filename)
-		io.Copy(w, r)
-		fmt.Fprintln(w, "\x00")
-	}()
+// sink writes records to a remote scp -t, each record and file content is
+// acknowledged by it.
+type sink struct {
+	w        *bufio.Writer
+	r        *bufio.Reader
+	warnings []string
+}
+
+// ack sends what was written and reads the answer of the remote scp: 0x00
+// accepts, 0x01 is a warning, the record was not accepted but the copy goes on,
+// 0x02 a fatal error. ok is false for warnings.
+func (k *sink) ack() (ok bool, err error) {
+	if err := k.w.Flush(); err != nil {
+		return false, err
+	}
+	b, err := k.r.ReadByte()
+	if err == io.EOF {
+		return false, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return false, err
+	}
+	if b == 0 {
+		return true, nil
+	}
+	l, err := k.r.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	message := redact.String(strings.TrimRight(l, "\n"))
+	switch b {
+	case 0x01:
+		k.warnings = append(k.warnings, message)
+		return false, nil
+	case 0x02:
+		return false, fmt.Errorf("error: %q", message)
+	}
+	return false, fmt.Errorf("invalid answer %q", append([]byte{b}, l...))
+}
+
+// record sends a C, D or T record.
+func (k *sink) record(line string) (bool, error) {
+	if strings.ContainsAny(line, "\n") {
+		return false, fmt.Errorf("record %q cannot be sent with scp", line)
+	}
+	if _, err := k.w.WriteString(line + "\n"); err != nil {
+		return false, err
+	}
+	return k.ack()
+}
+
+// file sends the C record and the size bytes of content of r. A file refused
+// by the remote scp is skipped, ok is false then.
+func (k *sink) file(r io.Reader, name string, mode os.FileMode, size int64) (bool, error) {
+	ok, err := k.record(fmt.Sprintf("C%04o %d %s", mode.Perm(), size, name))
+	if !ok || err != nil {
+		return false, err
+	}
+	if err := copyN(k.w, r, size); err != nil {
+		return false, err
+	}
+	if err := k.w.WriteByte(0); err != nil {
+		return false, err
+	}
+	return k.ack()
+}
 
-	err := a.Session.Run("scp -qt " + directory)
-	return err
+// bufferSize is the chunk a transfer is streamed in, the buffers are shared
+// by all transfers.
+const bufferSize = 32 * 1024
+
+var buffers = sync.Pool{New: func() interface{} {
+	b := make([]byte, bufferSize)
+	return &b
+}}
+
+// copyN copies exactly size bytes from r to w, a shorter r is an
+// io.ErrUnexpectedEOF.
+func copyN(w io.Writer, r io.Reader, size int64) error {
+	buf := buffers.Get().(*[]byte)
+	defer buffers.Put(buf)
+	b := *buf
+
+	var t int64
+	for t < size {
+		n, err := r.Read(b[:min(int64(len(b)), size-t)])
+		if n > 0 {
+			if _, err := w.Write(b[:n]); err != nil {
+				return err
+			}
+			t += int64(n)
+		}
+		if t == size {
+			// a reader may return io.EOF with the last bytes
+			return nil
+		}
+		if err == io.EOF {
+			// the connection ended before the whole file came
+			return io.ErrUnexpectedEOF
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func min(a, b int) int {
+func min(a, b int64) int64 {
 	if a < b {
 		return a
 	}
@@ -246,8 +427,16 @@ func parseCopy(l []byte) (os.FileMode, int64, string, error) {
 	if l[0] != 'C' {
 		return 0, 0, "", fmt.Errorf("invalid first byte; expected C but got %02x", l[0])
 	}
+	return parseRecord(l)
+}
 
-	bits := bytes.Split(bytes.TrimRight(l, "\n"), []byte(" "))
+// parseRecord reads a C (file) or D (directory) record,
+// C<mode> <size> <name>. Names leaving the target directory are rejected.
+func parseRecord(l []byte) (os.FileMode, int64, string, error) {
+	bits := bytes.SplitN(bytes.TrimRight(l, "\n"), []byte(" "), 3)
+	if len(bits) != 3 {
+		return 0, 0, "", fmt.Errorf("invalid copy record %q", l)
+	}
 
 	rawMode, err := strconv.ParseUint(string(bits[0][1:]), 8, 32)
 	if err != nil {
@@ -255,10 +444,18 @@ func parseCopy(l []byte) (os.FileMode, int64, string, error) {
 	}
 	mode := os.FileMode(uint32(rawMode))
 
-	size, err := strconv.ParseInt(string(bits[1]), 10, 32)
+	size, err := strconv.ParseInt(string(bits[1]), 10, 64)
 	if err != nil {
 		return 0, 0, "", err
 	}
+	if size < 0 {
+		return 0, 0, "", fmt.Errorf("invalid file size %d", size)
+	}
+
+	name := string(bits[2])
+	if name == "" || name == "." || name == ".." || strings.ContainsRune(name, '/') {
+		return 0, 0, "", fmt.Errorf("invalid file name %q", name)
+	}
 
-	return mode, size, string(bits[2]), nil
+	return mode, size, name, nil
 }
@@ -0,0 +1,77 @@
+package scp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestCopyN(t *testing.T) {
+	data := strings.Repeat("0123456789", 10000)
+	plain := func(r io.Reader) io.Reader { return r }
+	tests := []struct {
+		name string
+		in   string
+		wrap func(io.Reader) io.Reader
+		size int64
+		want error
+	}{
+		{"whole", data, plain, int64(len(data)), nil},
+		{"less than available", data, plain, 10, nil},
+		{"eof with the last bytes", data, iotest.DataErrReader, int64(len(data)), nil},
+		{"eof with the last byte", "abc", func(r io.Reader) io.Reader {
+			return iotest.DataErrReader(iotest.OneByteReader(r))
+		}, 3, nil},
+		{"empty", "", plain, 0, nil},
+		{"short", "abc", plain, 4, io.ErrUnexpectedEOF},
+		{"short with eof on data", "abc", iotest.DataErrReader, 4, io.ErrUnexpectedEOF},
+		{"read error", data, iotest.TimeoutReader, int64(len(data)), iotest.ErrTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var w bytes.Buffer
+			err := copyN(&w, tt.wrap(strings.NewReader(tt.in)), tt.size)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("err = %v, want %v", err, tt.want)
+			}
+			if err == nil && w.String() != tt.in[:tt.size] {
+				t.Errorf("copied %d bytes, want %d", w.Len(), tt.size)
+			}
+		})
+	}
+}
+
+func TestParseRecord(t *testing.T) {
+	tests := []struct {
+		record string
+		mode   uint32
+		size   int64
+		name   string
+		err    string
+	}{
+		{"C0644 12 app.ear\n", 0644, 12, "app.ear", ""},
+		{"D0755 0 lib\n", 0755, 0, "lib", ""},
+		{"C0600 0 with space.txt\n", 0600, 0, "with space.txt", ""},
+		{"C0644 -1 app.ear\n", 0, 0, "", "invalid file size"},
+		{"C0644 x app.ear\n", 0, 0, "", "invalid syntax"},
+		{"C0999 1 app.ear\n", 0, 0, "", "invalid syntax"},
+		{"C0644 1\n", 0, 0, "", "invalid copy record"},
+		{"C0644 1 a/b\n", 0, 0, "", "invalid file name"},
+		{"D0755 0 .\n", 0, 0, "", "invalid file name"},
+	}
+	for _, tt := range tests {
+		mode, size, name, err := parseRecord([]byte(tt.record))
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("parseRecord(%q): err = %v, want %q", tt.record, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || uint32(mode) != tt.mode || size != tt.size || name != tt.name {
+			t.Errorf("parseRecord(%q) = %o, %d, %q, %v", tt.record, mode, size, name, err)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package secret
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// Keystore is a local file of named secrets encrypted with AES-256-GCM under a
+// key derived from a passphrase with scrypt.
+type Keystore struct {
+	path       string
+	passphrase []byte
+	entries    map[string]string
+}
+
+type keystoreFile struct {
+	Salt  []byte `json:"salt"`
+	Nonce []byte `json:"nonce"`
+	Data  []byte `json:"data"`
+}
+
+// OpenKeystore decrypts the keystore at path. A missing file gives an empty
+// keystore that is created by Save.
+func OpenKeystore(path, passphrase string) (*Keystore, error) {
+	ks := &Keystore{path: path, passphrase: []byte(passphrase), entries: map[string]string{}}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return ks, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read keystore: %v", err)
+	}
+	file := keystoreFile{}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid keystore %s: %v", path, err)
+	}
+	gcm, err := ks.cipher(file.Salt)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := gcm.Open(nil, file.Nonce, file.Data, nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decrypt keystore %s: wrong passphrase or corrupted file", path)
+	}
+	if err := json.Unmarshal(plain, &ks.entries); err != nil {
+		return nil, fmt.Errorf("invalid keystore %s: %v", path, err)
+	}
+	return ks, nil
+}
+
+func (ks *Keystore) Get(name string) (string, bool) {
+	value, ok := ks.entries[name]
+	return value, ok
+}
+
+func (ks *Keystore) Set(name, value string) {
+	ks.entries[name] = value
+}
+
+// Save encrypts the keystore with a fresh salt and nonce and writes it.
+func (ks *Keystore) Save() error {
+	file := keystoreFile{Salt: make([]byte, 16)}
+	if _, err := rand.Read(file.Salt); err != nil {
+		return err
+	}
+	gcm, err := ks.cipher(file.Salt)
+	if err != nil {
+		return err
+	}
+	file.Nonce = make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(file.Nonce); err != nil {
+		return err
+	}
+	plain, err := json.Marshal(ks.entries)
+	if err != nil {
+		return err
+	}
+	file.Data = gcm.Seal(nil, file.Nonce, plain, nil)
+	data, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(ks.path, data, 0600); err != nil {
+		return fmt.Errorf("cannot write keystore: %v", err)
+	}
+	return nil
+}
+
+func (ks *Keystore) cipher(salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key(ks.passphrase, salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
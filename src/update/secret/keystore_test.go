@@ -0,0 +1,81 @@
+package secret
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestKeystoreRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keystore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keystore")
+
+	ks, err := OpenKeystore(path, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks.Set("db", "dbp'ass")
+	ks.Set("ssh", "")
+	if err := ks.Save(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "dbp'ass") {
+		t.Errorf("keystore file holds the plain secret: %s", data)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("keystore mode %v, %v", info.Mode(), err)
+	}
+
+	ks, err = OpenKeystore(path, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"db": "dbp'ass", "ssh": ""} {
+		if value, ok := ks.Get(name); !ok || value != want {
+			t.Errorf("%s = %q, %v; want %q", name, value, ok, want)
+		}
+	}
+	if _, ok := ks.Get("missing"); ok {
+		t.Error("missing entry found")
+	}
+
+	r := &Resolver{Keystore: func() (*Keystore, error) { return OpenKeystore(path, "correct horse") }}
+	if value, err := r.Resolve("keystore:db"); err != nil || value != "dbp'ass" {
+		t.Errorf("Resolve = %q, %v", value, err)
+	}
+}
+
+func TestKeystoreWrongPassphrase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keystore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keystore")
+
+	ks, err := OpenKeystore(path, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks.Set("db", "secret")
+	if err := ks.Save(); err != nil {
+		t.Fatal(err)
+	}
+	ks, err = OpenKeystore(path, "battery staple")
+	if err == nil || !strings.Contains(err.Error(), "wrong passphrase") {
+		t.Errorf("err = %v, want a wrong passphrase error", err)
+	}
+	if ks != nil {
+		t.Error("keystore opened with a wrong passphrase")
+	}
+}
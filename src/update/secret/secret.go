@@ -0,0 +1,90 @@
+package secret
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Resolver turns secret references into values. A reference is one of
+//
+//	env:NAME          value of the environment variable NAME
+//	file:/path        content of the file, trailing newline removed
+//	cmd:pass show x   standard output of the command run by sh -c
+//	keystore:NAME     entry NAME of the encrypted keystore
+//
+// Anything else is taken literally.
+type Resolver struct {
+	// Keystore opens the keystore on first use, it may be nil when no
+	// keystore is configured.
+	Keystore func() (*Keystore, error)
+
+	keystore *Keystore
+}
+
+// Resolve returns the value the reference points to.
+func (r *Resolver) Resolve(ref string) (string, error) {
+	kind, arg := split(ref)
+	switch kind {
+	case "env":
+		value, ok := os.LookupEnv(arg)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s not set", arg)
+		}
+		return value, nil
+	case "file":
+		data, err := ioutil.ReadFile(arg)
+		if err != nil {
+			return "", fmt.Errorf("cannot read secret file: %v", err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	case "cmd":
+		var stdout, stderr bytes.Buffer
+		cmd := exec.Command("sh", "-c", arg)
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			return "", fmt.Errorf("secret command %q failed: %v %s", arg, err, strings.TrimSpace(stderr.String()))
+		}
+		return strings.TrimRight(stdout.String(), "\r\n"), nil
+	case "keystore":
+		if r.keystore == nil {
+			if r.Keystore == nil {
+				return "", fmt.Errorf("no keystore configured for %s", ref)
+			}
+			ks, err := r.Keystore()
+			if err != nil {
+				return "", err
+			}
+			r.keystore = ks
+		}
+		value, ok := r.keystore.Get(arg)
+		if !ok {
+			return "", fmt.Errorf("keystore has no entry %s", arg)
+		}
+		return value, nil
+	}
+	return ref, nil
+}
+
+// IsReference reports whether value is a secret reference rather than a
+// literal value.
+func IsReference(value string) bool {
+	kind, _ := split(value)
+	return kind != ""
+}
+
+func split(ref string) (string, string) {
+	i := strings.Index(ref, ":")
+	if i < 0 {
+		return "", ref
+	}
+	switch kind := ref[:i]; kind {
+	case "env", "file", "cmd", "keystore":
+		return kind, ref[i+1:]
+	}
+	return "", ref
+}
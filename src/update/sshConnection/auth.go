@@ -0,0 +1,209 @@
+package sshConnection
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// Authentication methods, tried in the configured order.
+const (
+	AuthAgent               = "agent"
+	AuthKey                 = "key"
+	AuthPassword            = "password"
+	AuthKeyboardInteractive = "keyboard-interactive"
+)
+
+// AuthConfig selects how to authenticate to the remote host.
+type AuthConfig struct {
+	// Methods in the order they are tried, by default agent, key, password
+	// and keyboard-interactive. Password based methods are only used when
+	// Password is set.
+	Methods []string
+	// IdentityFiles are private keys in PEM or OpenSSH format (rsa, ecdsa,
+	// ed25519), by default ~/.ssh/id_ed25519, ~/.ssh/id_ecdsa and ~/.ssh/id_rsa.
+	IdentityFiles []string
+	// KeyPassphrase decrypts encrypted identity files.
+	KeyPassphrase string
+	Password      string
+}
+
+// AuthMethods builds the ssh auth methods in the configured order. ssh tries
+// every method type once only, so agent keys and identity files are offered
+// through a single public key method. The returned closer, nil without agent,
+// closes the connection to ssh-agent.
+func AuthMethods(conf AuthConfig) ([]ssh.AuthMethod, io.Closer, error) {
+	methods := conf.Methods
+	if len(methods) == 0 {
+		methods = []string{AuthAgent, AuthKey, AuthPassword, AuthKeyboardInteractive}
+	}
+	var (
+		auth    []ssh.AuthMethod
+		signers []func() ([]ssh.Signer, error)
+		keyAt   = -1
+		closer  io.Closer
+	)
+	for _, method := range methods {
+		switch method {
+		case AuthAgent:
+			if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+				a := &agentConn{sock: sock}
+				signers = append(signers, a.signers)
+				closer = a
+			}
+		case AuthKey:
+			keys, err := identitySigners(conf.IdentityFiles, conf.KeyPassphrase)
+			if err != nil {
+				return nil, nil, err
+			}
+			signers = append(signers, func() ([]ssh.Signer, error) { return keys, nil })
+		case AuthPassword:
+			if conf.Password != "" {
+				auth = append(auth, ssh.Password(conf.Password))
+			}
+			continue
+		case AuthKeyboardInteractive:
+			if conf.Password != "" {
+				auth = append(auth, ssh.KeyboardInteractive(answerPassword(conf.Password)))
+			}
+			continue
+		default:
+			return nil, nil, fmt.Errorf("unknown auth method %q", method)
+		}
+		if keyAt < 0 {
+			keyAt = len(auth)
+			auth = append(auth, nil)
+		}
+	}
+	if keyAt >= 0 {
+		auth[keyAt] = ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+			var all []ssh.Signer
+			for _, s := range signers {
+				keys, err := s()
+				if err != nil {
+					fmt.Println("Skipping ssh keys: " + err.Error())
+					continue
+				}
+				all = append(all, keys...)
+			}
+			return all, nil
+		})
+	}
+	if len(auth) == 0 {
+		return nil, nil, fmt.Errorf("no usable auth method among %v", methods)
+	}
+	return auth, closer, nil
+}
+
+// agentConn is the connection to ssh-agent. It is dialled on first use and
+// kept open, the agent signers sign through it.
+type agentConn struct {
+	sock string
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func (a *agentConn) signers() ([]ssh.Signer, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.conn == nil {
+		conn, err := net.Dial("unix", a.sock)
+		if err != nil {
+			return nil, fmt.Errorf("cannot connect to ssh-agent: %v", err)
+		}
+		a.conn = conn
+	}
+	keys, err := agent.NewClient(a.conn).Signers()
+	if err != nil {
+		a.conn.Close()
+		a.conn = nil
+	}
+	return keys, err
+}
+
+// Close closes the connection, the next handshake dials the agent again.
+func (a *agentConn) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.conn == nil {
+		return nil
+	}
+	err := a.conn.Close()
+	a.conn = nil
+	return err
+}
+
+// identitySigners loads the identity files. Default files that are missing or
+// cannot be decrypted are skipped (an encrypted key is usually loaded in
+// ssh-agent), configured files must load.
+func identitySigners(files []string, passphrase string) ([]ssh.Signer, error) {
+	explicit := len(files) > 0
+	if !explicit {
+		usr, err := user.Current()
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+			files = append(files, filepath.Join(usr.HomeDir, ".ssh", name))
+		}
+	}
+	var signers []ssh.Signer
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if os.IsNotExist(err) && !explicit {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to load identity: %v", err)
+		}
+		signer, err := parsePrivateKey(data, passphrase)
+		if err != nil && !explicit {
+			fmt.Println("Skipping ssh key " + file + ": " + err.Error())
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot read ssh key %s: %v", file, err)
+		}
+		signers = append(signers, signer)
+	}
+	return signers, nil
+}
+
+// parsePrivateKey understands plain and encrypted keys, both legacy PEM and
+// the OpenSSH format.
+func parsePrivateKey(data []byte, passphrase string) (ssh.Signer, error) {
+	signer, err := ssh.ParsePrivateKey(data)
+	if _, ok := err.(*ssh.PassphraseMissingError); !ok {
+		return signer, err
+	}
+	if passphrase == "" {
+		return nil, fmt.Errorf("key is encrypted and no passphrase is set")
+	}
+	signer, err = ssh.ParsePrivateKeyWithPassphrase(data, []byte(passphrase))
+	if err != nil {
+		return nil, fmt.Errorf("decrypt failed: %v", err)
+	}
+	return signer, nil
+}
+
+// answerPassword answers every hidden keyboard-interactive prompt with the
+// password.
+func answerPassword(password string) ssh.KeyboardInteractiveChallenge {
+	return func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+		answers := make([]string, len(questions))
+		for i := range questions {
+			if !echos[i] {
+				answers[i] = password
+			}
+		}
+		return answers, nil
+	}
+}
@@ -0,0 +1,107 @@
+package sshConnection
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// fakeAgent serves a keyring with one key on a unix socket and reports every
+// accepted connection and its end.
+func fakeAgent(t *testing.T) (sock string, accepted, closed chan struct{}, stop func()) {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: key}); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sock = filepath.Join(dir, "agent.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, closed = make(chan struct{}, 10), make(chan struct{}, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- struct{}{}
+			go func() {
+				agent.ServeAgent(keyring, conn)
+				closed <- struct{}{}
+			}()
+		}
+	}()
+	return sock, accepted, closed, func() {
+		l.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestAgentConnection(t *testing.T) {
+	sock, accepted, closed, stop := fakeAgent(t)
+	defer stop()
+
+	a := &agentConn{sock: sock}
+	for i := 0; i < 2; i++ {
+		keys, err := a.signers()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) != 1 {
+			t.Fatalf("%d agent keys, want 1", len(keys))
+		}
+		// the signer works through the kept connection
+		if _, err := keys[0].Sign(rand.Reader, []byte("session")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(accepted) != 1 {
+		t.Errorf("%d connections to the agent, want 1", len(accepted))
+	}
+	if len(closed) != 0 {
+		t.Error("agent connection closed before Close")
+	}
+
+	client := &Client{agents: []io.Closer{a}}
+	client.Close()
+	<-closed
+	if _, err := a.signers(); err != nil {
+		t.Fatal(err)
+	}
+	if len(accepted) != 2 {
+		t.Errorf("no new connection to the agent after Close")
+	}
+	a.Close()
+}
+
+func TestAuthMethodsWithoutAgent(t *testing.T) {
+	defer os.Setenv("SSH_AUTH_SOCK", os.Getenv("SSH_AUTH_SOCK"))
+	os.Unsetenv("SSH_AUTH_SOCK")
+	methods, agent, err := AuthMethods(AuthConfig{Methods: []string{AuthAgent, AuthPassword}, Password: "pw"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if agent != nil {
+		t.Error("closer without an agent")
+	}
+	if len(methods) != 2 {
+		t.Errorf("%d methods, want the key and password method", len(methods))
+	}
+}
@@ -0,0 +1,42 @@
+package sshConnection
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	// ErrAuth is returned when the server accepted none of the auth methods.
+	ErrAuth = errors.New("ssh authentication failed")
+	// ErrRemoteCommand matches every *RemoteCommandError.
+	ErrRemoteCommand = errors.New("remote command failed")
+)
+
+// RemoteCommandError is a remote command that exited with a non zero status.
+type RemoteCommandError struct {
+	Cmd      string
+	ExitCode int
+	Stderr   string
+}
+
+func (e *RemoteCommandError) Error() string {
+	msg := fmt.Sprintf("remote command %q failed with exit code %d", e.Cmd, e.ExitCode)
+	if stderr := strings.TrimSpace(e.Stderr); stderr != "" {
+		msg += ": " + stderr
+	}
+	return msg
+}
+
+func (e *RemoteCommandError) Is(target error) bool {
+	return target == ErrRemoteCommand
+}
+
+// connectError tells failed authentication apart from other failures to
+// reach the host, the ssh package reports both as plain errors.
+func connectError(host string, err error) error {
+	if strings.Contains(err.Error(), "unable to authenticate") {
+		return fmt.Errorf("%w to %s: %v", ErrAuth, host, err)
+	}
+	return fmt.Errorf("cannot connect to %s: %w", host, err)
+}
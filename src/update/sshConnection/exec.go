@@ -0,0 +1,226 @@
+package sshConnection
+
+import (
+	"../redact"
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Result is the outcome of a remote command.
+type Result struct {
+	Stdout   string
+	Stderr   string
+	ExitCode int
+}
+
+func (r Result) Success() bool {
+	return r.ExitCode == 0
+}
+
+// Run executes the command in its own session and returns its output and exit
+// status. A non zero exit status is not an error, it is reported in Result,
+// except a failed RunAs escalation which gives a *PrivilegeError.
+//
+// When ctx is done or CommandTimeout passes, the remote command is killed, its
+// session closed and the context error returned.
+func (a *Client) Run(ctx context.Context, cmd Command) (Result, error) {
+	if a.CommandTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, a.CommandTimeout)
+		defer cancel()
+	}
+	if err := ctx.Err(); err != nil {
+		return Result{}, err
+	}
+	if runAs := cmd.RunAs; runAs != nil {
+		wrapped, err := runAs.wrap(cmd)
+		if err != nil {
+			return Result{}, err
+		}
+		res, err := a.run(ctx, wrapped)
+		if err == nil {
+			err = runAs.check(res)
+		}
+		return res, err
+	}
+	return a.run(ctx, cmd)
+}
+
+func (a *Client) run(ctx context.Context, cmd Command) (res Result, err error) {
+	session, err := a.NewSession(ctx)
+	if err != nil {
+		return Result{}, err
+	}
+	defer session.Close()
+	stop := Interrupt(ctx, session)
+	defer func() {
+		if stop() {
+			res.ExitCode = -1
+			err = ctx.Err()
+		}
+	}()
+
+	var stdout, stderr bytes.Buffer
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+	if cmd.Pty {
+		// with a terminal the input must stay open until the command ends,
+		// programs like su read their password from it
+		modes := ssh.TerminalModes{
+			ssh.ECHO:          0,
+			ssh.TTY_OP_ISPEED: 14400,
+			ssh.TTY_OP_OSPEED: 14400,
+		}
+		if err := session.RequestPty("xterm", 80, 40, modes); err != nil {
+			return Result{}, err
+		}
+		w, err := session.StdinPipe()
+		if err != nil {
+			return Result{}, err
+		}
+		defer w.Close()
+		prompted := make(chan struct{})
+		if cmd.Prompt != "" {
+			session.Stdout = &promptWriter{buf: &stdout, prompt: []byte(cmd.Prompt), seen: prompted}
+		}
+		if err := session.Start(cmd.Cmd); err != nil {
+			return Result{}, err
+		}
+		waited := make(chan error, 1)
+		go func() {
+			waited <- session.Wait()
+		}()
+		if cmd.Prompt != "" {
+			select {
+			case <-prompted:
+			case err := <-waited:
+				// ended without asking, e.g. su run by root
+				return result(&stdout, &stderr, err)
+			case <-time.After(promptTimeout):
+				return Result{ExitCode: -1}, fmt.Errorf("no %q prompt within %v", cmd.Prompt, promptTimeout)
+			}
+		}
+		if _, err := w.Write([]byte(cmd.Stdin)); err != nil {
+			return Result{}, err
+		}
+		return result(&stdout, &stderr, <-waited)
+	}
+	if cmd.Stdin != "" {
+		session.Stdin = strings.NewReader(cmd.Stdin)
+	}
+	return result(&stdout, &stderr, session.Run(cmd.Cmd))
+}
+
+// promptTimeout limits the wait for the Prompt of a command.
+var promptTimeout = 30 * time.Second
+
+// promptWriter collects the output of a command and closes seen once it
+// contains prompt.
+type promptWriter struct {
+	buf    *bytes.Buffer
+	prompt []byte
+	seen   chan struct{}
+	found  bool
+}
+
+func (w *promptWriter) Write(p []byte) (int, error) {
+	n, err := w.buf.Write(p)
+	if !w.found && bytes.Contains(w.buf.Bytes(), w.prompt) {
+		w.found = true
+		close(w.seen)
+	}
+	return n, err
+}
+
+func result(stdout, stderr *bytes.Buffer, err error) (Result, error) {
+	res := Result{Stdout: stdout.String(), Stderr: stderr.String()}
+	switch e := err.(type) {
+	case nil:
+		return res, nil
+	case *ssh.ExitError:
+		res.ExitCode = e.ExitStatus()
+		return res, nil
+	case *ssh.ExitMissingError:
+		res.ExitCode = -1
+		return res, fmt.Errorf("remote command exited without status")
+	}
+	return res, err
+}
+
+// Interrupt kills the command of the session and closes it when ctx is done.
+// The returned stop ends the watch and reports whether it had fired.
+func Interrupt(ctx context.Context, session *Session) (stop func() bool) {
+	done := make(chan struct{})
+	fired := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// not every server honours signals, closing the channel ends the
+			// command on the others
+			session.Signal(ssh.SIGKILL)
+			session.Close()
+			fired <- true
+		case <-done:
+			fired <- false
+		}
+	}()
+	return func() bool {
+		close(done)
+		return <-fired
+	}
+}
+
+// connectionExec runs every command in its own session of the client.
+type connectionExec struct {
+	ctx    context.Context
+	client *Client
+	last   Result
+	err    error
+}
+
+func (conn *connectionExec) Execute(cmd Command) Result {
+	if cmd.Secret {
+		redact.Println(redact.Mask + " executed")
+	} else {
+		redact.Println(cmd.Line() + " executed")
+	}
+	res, err := conn.client.Run(conn.ctx, cmd)
+	if err != nil && res.Success() {
+		res.ExitCode = -1
+	}
+	if err == nil && !res.Success() {
+		line := cmd.Line()
+		if cmd.Secret {
+			line = redact.Mask
+		}
+		err = &RemoteCommandError{Cmd: line, ExitCode: res.ExitCode, Stderr: res.Stderr}
+	}
+	conn.err = err
+	if out := strings.TrimSpace(res.Stdout); out != "" {
+		redact.Println(out)
+	}
+	conn.last = res
+	return res
+}
+
+// IsSuccess reports whether the last executed command exited with status 0.
+func (conn *connectionExec) IsSuccess() bool {
+	return conn.last.Success()
+}
+
+func (conn *connectionExec) Valid() error {
+	if conn.err != nil {
+		return redact.Error(conn.err)
+	}
+	return nil
+}
+
+// ShellQuote quotes s as a single POSIX shell word.
+func ShellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,266 @@
+package sshConnection
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Host key verification modes.
+const (
+	HostKeyKnownHosts  = "known-hosts"
+	HostKeyFingerprint = "fingerprint"
+	HostKeyTOFU        = "tofu"
+	HostKeyInsecure    = "insecure"
+)
+
+// HostKeyConfig selects how the remote host key is verified. Mode defaults to
+// HostKeyFingerprint when Fingerprint is set and to HostKeyKnownHosts
+// otherwise; KnownHostsFile defaults to ~/.ssh/known_hosts.
+type HostKeyConfig struct {
+	Mode           string
+	KnownHostsFile string
+	// Fingerprint is the pinned SHA256 fingerprint as printed by
+	// ssh-keygen -lf, e.g. SHA256:uNiVztksCsDhcc0u9e8BujQXVUpKZIDTMczCvj3tD2s
+	Fingerprint string
+}
+
+// HostKeyChangedError is returned when the host presents a key different from
+// the recorded or pinned one.
+type HostKeyChangedError struct {
+	Host        string
+	Fingerprint string
+	Expected    string
+}
+
+func (e *HostKeyChangedError) Error() string {
+	return fmt.Sprintf("host key of %s has changed: got %s, expected %s; "+
+		"if the change is legitimate update the known_hosts entry or the pinned fingerprint",
+		e.Host, e.Fingerprint, e.Expected)
+}
+
+// UnknownHostError is returned when the host is not in the known_hosts file,
+// or only with keys of other types than the presented one (KnownTypes).
+type UnknownHostError struct {
+	Host        string
+	Fingerprint string
+	File        string
+	KeyType     string
+	KnownTypes  []string
+}
+
+func (e *UnknownHostError) Error() string {
+	if len(e.KnownTypes) > 0 {
+		return fmt.Sprintf("host %s presents a %s key (%s) but %s has only %s keys for it; add it with ssh-keyscan -t %s",
+			e.Host, e.KeyType, e.Fingerprint, e.File, strings.Join(e.KnownTypes, ", "), e.KeyType)
+	}
+	return fmt.Sprintf("host %s (%s) is not in %s; add it with ssh-keyscan or use host key mode %s",
+		e.Host, e.Fingerprint, e.File, HostKeyTOFU)
+}
+
+// resolve returns the effective mode and, for the known_hosts modes, the file.
+func (conf HostKeyConfig) resolve() (mode, file string, err error) {
+	mode = conf.Mode
+	if mode == "" {
+		mode = HostKeyKnownHosts
+		if conf.Fingerprint != "" {
+			mode = HostKeyFingerprint
+		}
+	}
+	if mode != HostKeyKnownHosts && mode != HostKeyTOFU {
+		return mode, "", nil
+	}
+	file = conf.KnownHostsFile
+	if file == "" {
+		usr, err := user.Current()
+		if err != nil {
+			return "", "", err
+		}
+		file = filepath.Join(usr.HomeDir, ".ssh", "known_hosts")
+	}
+	return mode, file, nil
+}
+
+// HostKeyCallback builds the callback verifying host keys as configured.
+func HostKeyCallback(conf HostKeyConfig) (ssh.HostKeyCallback, error) {
+	mode, file, err := conf.resolve()
+	if err != nil {
+		return nil, err
+	}
+	switch mode {
+	case HostKeyInsecure:
+		return ssh.InsecureIgnoreHostKey(), nil
+	case HostKeyFingerprint:
+		if conf.Fingerprint == "" {
+			return nil, fmt.Errorf("host key mode %s requires a fingerprint", mode)
+		}
+		return pinnedHostKey(conf.Fingerprint), nil
+	case HostKeyKnownHosts, HostKeyTOFU:
+		return knownHostsKey(file, mode == HostKeyTOFU)
+	}
+	return nil, fmt.Errorf("unknown host key mode %q", mode)
+}
+
+// hostKeyAlgorithms are the algorithms of every key type, in the preference
+// order of OpenSSH.
+var hostKeyAlgorithms = map[string][]string{
+	ssh.KeyAlgoED25519:  {ssh.KeyAlgoED25519},
+	ssh.KeyAlgoECDSA256: {ssh.KeyAlgoECDSA256},
+	ssh.KeyAlgoECDSA384: {ssh.KeyAlgoECDSA384},
+	ssh.KeyAlgoECDSA521: {ssh.KeyAlgoECDSA521},
+	ssh.KeyAlgoRSA:      {ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA},
+}
+
+var keyTypeOrder = []string{ssh.KeyAlgoED25519, ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521, ssh.KeyAlgoRSA}
+
+// HostKeyAlgorithms returns the host key algorithms to offer to host (as
+// host:port): those of the key types recorded for it in known_hosts first, so
+// the server presents a key that can be verified, then the others. It is nil,
+// the library default, in the other modes or for a host not recorded.
+func HostKeyAlgorithms(conf HostKeyConfig, host string) ([]string, error) {
+	mode, file, err := conf.resolve()
+	if err != nil || file == "" {
+		return nil, err
+	}
+	known, err := knownTypes(file, host)
+	if err != nil || len(known) == 0 {
+		if mode == HostKeyTOFU && os.IsNotExist(err) {
+			err = nil
+		}
+		return nil, err
+	}
+	var algorithms []string
+	for _, types := range [][]string{known, keyTypeOrder} {
+		for _, t := range types {
+			for _, a := range hostKeyAlgorithms[t] {
+				if !contains(algorithms, a) {
+					algorithms = append(algorithms, a)
+				}
+			}
+		}
+	}
+	return algorithms, nil
+}
+
+// knownTypes returns the key types recorded for host, in keyTypeOrder.
+func knownTypes(file, host string) ([]string, error) {
+	check, err := knownhosts.New(file)
+	if err != nil {
+		return nil, err
+	}
+	// No key matches the empty one, the error lists every recorded key.
+	err = check(host, &net.TCPAddr{IP: net.IPv4zero}, emptyKey{})
+	var keyErr *knownhosts.KeyError
+	if !errors.As(err, &keyErr) {
+		return nil, nil
+	}
+	var types []string
+	for _, t := range keyTypeOrder {
+		for _, want := range keyErr.Want {
+			if want.Key.Type() == t {
+				types = append(types, t)
+				break
+			}
+		}
+	}
+	return types, nil
+}
+
+// emptyKey is a public key of no known type.
+type emptyKey struct{}
+
+func (emptyKey) Type() string                        { return "none" }
+func (emptyKey) Marshal() []byte                     { return nil }
+func (emptyKey) Verify([]byte, *ssh.Signature) error { return errors.New("empty key") }
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func pinnedHostKey(fingerprint string) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if got := ssh.FingerprintSHA256(key); got != fingerprint {
+			return &HostKeyChangedError{Host: hostname, Fingerprint: got, Expected: fingerprint}
+		}
+		return nil
+	}
+}
+
+func knownHostsKey(file string, tofu bool) (ssh.HostKeyCallback, error) {
+	if tofu {
+		if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+			return nil, err
+		}
+		f, err := os.OpenFile(file, os.O_CREATE|os.O_RDONLY, 0600)
+		if err != nil {
+			return nil, err
+		}
+		f.Close()
+	}
+	check, err := knownhosts.New(file)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read known hosts: %v", err)
+	}
+	var mu sync.Mutex
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		mu.Lock()
+		defer mu.Unlock()
+		err := check(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		if !errors.As(err, &keyErr) {
+			return err
+		}
+		fingerprint := ssh.FingerprintSHA256(key)
+		// Only a recorded key of the same type makes a changed key, a host
+		// known with other types is not trusted on first use either.
+		var types []string
+		for _, want := range keyErr.Want {
+			if want.Key.Type() == key.Type() {
+				return &HostKeyChangedError{
+					Host:        hostname,
+					Fingerprint: fingerprint,
+					Expected:    fmt.Sprintf("%s (%s:%d)", ssh.FingerprintSHA256(want.Key), want.Filename, want.Line),
+				}
+			}
+			types = append(types, want.Key.Type())
+		}
+		if len(types) > 0 {
+			return &UnknownHostError{Host: hostname, Fingerprint: fingerprint, File: file, KeyType: key.Type(), KnownTypes: types}
+		}
+		if !tofu {
+			return &UnknownHostError{Host: hostname, Fingerprint: fingerprint, File: file}
+		}
+		if err := appendKnownHost(file, hostname, key); err != nil {
+			return err
+		}
+		check, err = knownhosts.New(file)
+		if err != nil {
+			return err
+		}
+		fmt.Println("Trusting new host key of " + hostname + " " + fingerprint + ", recorded in " + file)
+		return nil
+	}, nil
+}
+
+func appendKnownHost(file, hostname string, key ssh.PublicKey) error {
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("cannot record host key: %v", err)
+	}
+	defer f.Close()
+	_, err = fmt.Fprintln(f, knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key))
+	return err
+}
@@ -0,0 +1,110 @@
+package sshConnection
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Hop is a jump host the connection to the target is tunnelled through.
+type Hop struct {
+	Host         string
+	ClientConfig *ssh.ClientConfig
+}
+
+// JumpSpec is one entry of an OpenSSH ProxyJump value, [user@]host[:port].
+type JumpSpec struct {
+	User string
+	Host string
+	Port string
+}
+
+// ParseProxyJump splits a ProxyJump value like "admin@bastion:2222,inner"
+// into its hops, in connection order.
+func ParseProxyJump(value string) ([]JumpSpec, error) {
+	var specs []JumpSpec
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" || part == "none" {
+			continue
+		}
+		spec := JumpSpec{}
+		if i := strings.LastIndex(part, "@"); i >= 0 {
+			spec.User, part = part[:i], part[i+1:]
+		}
+		if host, port, err := net.SplitHostPort(part); err == nil {
+			spec.Host, spec.Port = host, port
+		} else {
+			spec.Host = strings.Trim(part, "[]")
+		}
+		if spec.Host == "" {
+			return nil, fmt.Errorf("invalid jump host %q", part)
+		}
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+// dial connects to the target through the jump hosts. The clients of the jump
+// hosts are returned to be closed with the connection.
+func (a *Client) dial(ctx context.Context) (*ssh.Client, []*ssh.Client, error) {
+	var via *ssh.Client
+	var jumps []*ssh.Client
+	for _, hop := range a.Jumps {
+		client, err := dialVia(ctx, via, hop.Host, hop.ClientConfig)
+		if err != nil {
+			closeClients(jumps)
+			return nil, nil, fmt.Errorf("jump host: %w", connectError(hop.Host, err))
+		}
+		jumps = append(jumps, client)
+		via = client
+	}
+	client, err := dialVia(ctx, via, a.Host, a.ClientConfig)
+	if err != nil {
+		closeClients(jumps)
+		return nil, nil, connectError(a.Host, err)
+	}
+	return client, jumps, nil
+}
+
+func dialVia(ctx context.Context, via *ssh.Client, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	var conn net.Conn
+	var err error
+	if via == nil {
+		conn, err = (&net.Dialer{Timeout: config.Timeout}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = via.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// the handshake does not take a context, closing the connection aborts it
+	handshake := make(chan struct{})
+	defer close(handshake)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-handshake:
+		}
+	}()
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// closeClients closes the clients of a tunnel, innermost first.
+func closeClients(clients []*ssh.Client) {
+	for i := len(clients) - 1; i >= 0; i-- {
+		clients[i].Close()
+	}
+}
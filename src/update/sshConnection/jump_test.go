@@ -0,0 +1,40 @@
+package sshConnection
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseProxyJump(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []JumpSpec
+	}{
+		{"bastion", []JumpSpec{{Host: "bastion"}}},
+		{"admin@bastion:2222", []JumpSpec{{User: "admin", Host: "bastion", Port: "2222"}}},
+		{"admin@bastion:2222,inner", []JumpSpec{{User: "admin", Host: "bastion", Port: "2222"}, {Host: "inner"}}},
+		{" a , b@c ", []JumpSpec{{Host: "a"}, {User: "b", Host: "c"}}},
+		{"me@corp.pl@bastion", []JumpSpec{{User: "me@corp.pl", Host: "bastion"}}},
+		{"[::1]:2222", []JumpSpec{{Host: "::1", Port: "2222"}}},
+		{"[fe80::1]", []JumpSpec{{Host: "fe80::1"}}},
+		{"root@fe80::1", []JumpSpec{{User: "root", Host: "fe80::1"}}},
+		{"none", nil},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		got, err := ParseProxyJump(tt.value)
+		if err != nil {
+			t.Errorf("ParseProxyJump(%q): %v", tt.value, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseProxyJump(%q) = %+v, want %+v", tt.value, got, tt.want)
+		}
+	}
+
+	for _, value := range []string{"admin@", ":22", "bastion,@:22"} {
+		if _, err := ParseProxyJump(value); err == nil {
+			t.Errorf("ParseProxyJump(%q) accepted", value)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package sshConnection
+
+import (
+	"../redact"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// DefaultKeepAliveCountMax is the number of unanswered keepalives after
+	// which the connection is considered dead, as ServerAliveCountMax of ssh.
+	DefaultKeepAliveCountMax = 3
+	// DefaultReconnectDelay is the first wait before dialling again, it
+	// doubles on every attempt up to maxReconnectDelay.
+	DefaultReconnectDelay = time.Second
+	maxReconnectDelay     = 30 * time.Second
+)
+
+// ErrConnectionLost is returned by Retry when the connection dropped and
+// could not be restored.
+var ErrConnectionLost = errors.New("ssh connection lost")
+
+// ping sends a keepalive@openssh.com request. Servers answer it with a
+// failure, any answer proves the transport works.
+func ping(client *ssh.Client, timeout time.Duration) error {
+	answer := make(chan error, 1)
+	go func() {
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		answer <- err
+	}()
+	select {
+	case err := <-answer:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("no keepalive answer within %v", timeout)
+	}
+}
+
+// keepAlive pings the server every KeepAliveInterval and drops the
+// connection after KeepAliveCountMax missed answers, so the sessions on it
+// fail instead of hanging on a dead network.
+func (a *Client) keepAlive(client *ssh.Client) {
+	if a.KeepAliveInterval <= 0 {
+		return
+	}
+	max := a.KeepAliveCountMax
+	if max <= 0 {
+		max = DefaultKeepAliveCountMax
+	}
+	ticker := time.NewTicker(a.KeepAliveInterval)
+	defer ticker.Stop()
+	missed := 0
+	for range ticker.C {
+		if !a.isCurrent(client) {
+			return
+		}
+		if err := ping(client, a.KeepAliveInterval); err != nil {
+			missed++
+			if missed >= max {
+				redact.Println(fmt.Sprintf("Connection to %s not responding: %v", a.Host, err))
+				a.drop(client)
+				return
+			}
+			continue
+		}
+		missed = 0
+	}
+}
+
+func (a *Client) isCurrent(client *ssh.Client) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.client == client
+}
+
+// lost reports whether an established connection is gone, dropping it if the
+// server no longer answers. It is false when no connection was ever made.
+func (a *Client) lost() bool {
+	a.mu.Lock()
+	client, connected := a.client, a.connected
+	a.mu.Unlock()
+	if client == nil {
+		return connected
+	}
+	if !alive(client) {
+		a.drop(client)
+		return true
+	}
+	return false
+}
+
+// Retry runs an idempotent operation, like reading a file, and runs it again
+// when it failed because the connection dropped. Up to ReconnectAttempts
+// retries are made with a growing delay; the next session reconnects. Failures
+// of the first connection and those waiting does not fix (authentication, host
+// keys) are returned as they are.
+func (a *Client) Retry(ctx context.Context, op func(ctx context.Context) error) error {
+	delay := a.reconnectDelay()
+	for attempt := 0; ; attempt++ {
+		err := op(ctx)
+		if err == nil || ctx.Err() != nil || !retryable(err) || !a.lost() {
+			return err
+		}
+		if attempt >= a.ReconnectAttempts {
+			return fmt.Errorf("%w: %v", ErrConnectionLost, err)
+		}
+		redact.Println(fmt.Sprintf("Connection to %s lost (%v), retrying in %v", a.Host, err, delay))
+		if err := sleep(ctx, delay); err != nil {
+			return err
+		}
+		delay = nextDelay(delay)
+	}
+}
+
+// redial dials again after a dropped connection, with backoff, unless the
+// failure is one that waiting does not fix.
+func (a *Client) redial(ctx context.Context) (*ssh.Client, []*ssh.Client, error) {
+	delay := a.reconnectDelay()
+	for attempt := 0; ; attempt++ {
+		client, jumps, err := a.dial(ctx)
+		if err == nil || attempt >= a.ReconnectAttempts || !retryable(err) || ctx.Err() != nil {
+			return client, jumps, err
+		}
+		redact.Println(fmt.Sprintf("Reconnecting to %s failed (%v), retrying in %v", a.Host, err, delay))
+		if err := sleep(ctx, delay); err != nil {
+			return nil, nil, err
+		}
+		delay = nextDelay(delay)
+	}
+}
+
+func retryable(err error) bool {
+	var changed *HostKeyChangedError
+	var unknown *UnknownHostError
+	return !errors.Is(err, ErrAuth) && !errors.As(err, &changed) && !errors.As(err, &unknown)
+}
+
+func (a *Client) reconnectDelay() time.Duration {
+	if a.ReconnectDelay > 0 {
+		return a.ReconnectDelay
+	}
+	return DefaultReconnectDelay
+}
+
+func nextDelay(delay time.Duration) time.Duration {
+	if delay *= 2; delay > maxReconnectDelay {
+		return maxReconnectDelay
+	}
+	return delay
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,120 @@
+package sshConnection
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Privilege escalation methods of RunAs.
+const (
+	// RunAsSudo runs sudo -n -u user, sudo must not ask for a password.
+	RunAsSudo = "sudo"
+	// RunAsSudoPassword runs sudo -S -u user with the password fed on stdin.
+	RunAsSudoPassword = "sudo-password"
+	// RunAsSu runs su - user -c with the password typed into a terminal
+	// once su asks for it.
+	RunAsSu = "su"
+)
+
+var (
+	ErrWrongPassword    = errors.New("wrong password")
+	ErrNotInSudoers     = errors.New("user not allowed to sudo")
+	ErrPasswordRequired = errors.New("password required")
+)
+
+// RunAs runs a command as another user on the remote host.
+type RunAs struct {
+	User     string
+	Method   string
+	Password string
+}
+
+// PrivilegeError reports a failed privilege escalation, Err is one of
+// ErrWrongPassword, ErrNotInSudoers or ErrPasswordRequired.
+type PrivilegeError struct {
+	User   string
+	Method string
+	Err    error
+	Output string
+}
+
+func (e *PrivilegeError) Error() string {
+	return fmt.Sprintf("%s to %s failed: %v: %s", e.Method, e.User, e.Err, strings.TrimSpace(e.Output))
+}
+
+func (e *PrivilegeError) Unwrap() error {
+	return e.Err
+}
+
+// sudoPrompt replaces the sudo prompt so it can be told apart from the output.
+const sudoPrompt = "[sudo password required]"
+
+// suPrompt is the password prompt of su, which runs in the C locale to print
+// it in English.
+const suPrompt = "Password:"
+
+// Line returns the command line actually run on the remote host.
+func (c Command) Line() string {
+	if c.RunAs == nil {
+		return c.Cmd
+	}
+	wrapped, err := c.RunAs.wrap(c)
+	if err != nil {
+		return c.Cmd
+	}
+	return wrapped.Cmd
+}
+
+// wrap returns the command run as r.User.
+func (r *RunAs) wrap(cmd Command) (Command, error) {
+	quoted := ShellQuote(cmd.Cmd)
+	switch r.Method {
+	case RunAsSudo:
+		cmd.Cmd = "sudo -n -u " + ShellQuote(r.User) + " -- sh -c " + quoted
+	case RunAsSudoPassword:
+		cmd.Cmd = "sudo -S -p " + ShellQuote(sudoPrompt) + " -u " + ShellQuote(r.User) + " -- sh -c " + quoted
+		cmd.Stdin = r.Password + "\n" + cmd.Stdin
+	case "", RunAsSu:
+		// su flushes the terminal input before it prompts, the password is
+		// typed after the prompt
+		cmd.Cmd = "LC_ALL=C su - " + ShellQuote(r.User) + " -c " + quoted
+		cmd.Stdin = r.Password + "\n" + cmd.Stdin
+		cmd.Pty = true
+		cmd.Prompt = suPrompt
+	default:
+		return cmd, fmt.Errorf("unknown run as method %q", r.Method)
+	}
+	cmd.RunAs = nil
+	return cmd, nil
+}
+
+// check recognizes failures of the escalation itself in a failed result.
+func (r *RunAs) check(res Result) error {
+	if res.Success() {
+		return nil
+	}
+	output := res.Stderr + "\n" + res.Stdout
+	lower := strings.ToLower(output)
+	var err error
+	switch {
+	case strings.Contains(lower, "not in the sudoers"),
+		strings.Contains(lower, "is not allowed to execute"),
+		strings.Contains(lower, "may not run sudo"):
+		err = ErrNotInSudoers
+	case strings.Contains(lower, "incorrect password"),
+		strings.Contains(lower, "sorry, try again"),
+		strings.Contains(lower, "authentication failure"):
+		err = ErrWrongPassword
+	case strings.Contains(lower, "a password is required"),
+		strings.Contains(lower, "no password was provided"):
+		err = ErrPasswordRequired
+	default:
+		return nil
+	}
+	method := r.Method
+	if method == "" {
+		method = RunAsSu
+	}
+	return &PrivilegeError{User: r.User, Method: method, Err: err, Output: strings.Replace(output, sudoPrompt, "", -1)}
+}
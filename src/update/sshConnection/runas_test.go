@@ -0,0 +1,265 @@
+package sshConnection
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// suServer is a fake ssh server whose commands behave like su: the terminal
+// input is flushed, then "Password:" printed and a line read. A command
+// containing "read" prints the next input line as well.
+type suServer struct {
+	password string
+	// silent commands end at once without a prompt, hanging ones never
+	// prompt and never end
+	silent, hanging bool
+}
+
+// start serves on a local port and returns a client of the server and a
+// function stopping the server.
+func (s *suServer) start(t *testing.T) (*Client, func()) {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(signer)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn, config)
+		}
+	}()
+	return &Client{Host: l.Addr().String(), ClientConfig: &ssh.ClientConfig{
+		User:            "deploy",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}}, func() { l.Close() }
+}
+
+func (s *suServer) serve(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for newChannel := range chans {
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range requests {
+				switch req.Type {
+				case "pty-req":
+					req.Reply(true, nil)
+				case "exec":
+					var exec struct{ Command string }
+					ssh.Unmarshal(req.Payload, &exec)
+					req.Reply(true, nil)
+					go s.run(channel, exec.Command)
+				default:
+					req.Reply(false, nil)
+				}
+			}
+		}()
+	}
+}
+
+// terminal is the input side of the fake terminal.
+type terminal struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (in *terminal) flush() {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.buf.Reset()
+}
+
+func (in *terminal) readLine() (string, bool) {
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		in.mu.Lock()
+		line, err := in.buf.ReadString('\n')
+		if err == nil {
+			in.mu.Unlock()
+			return strings.TrimSuffix(line, "\n"), true
+		}
+		// put back the partial line
+		rest := in.buf.String()
+		in.buf.Reset()
+		in.buf.WriteString(line + rest)
+		in.mu.Unlock()
+	}
+	return "", false
+}
+
+func (s *suServer) run(channel ssh.Channel, command string) {
+	defer channel.Close()
+	in := &terminal{}
+	go func() {
+		data := make([]byte, 256)
+		for {
+			n, err := channel.Read(data)
+			in.mu.Lock()
+			in.buf.Write(data[:n])
+			in.mu.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}()
+	exit := func(status uint32) {
+		channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+	}
+	if s.silent {
+		channel.Write([]byte("done\r\n"))
+		exit(0)
+		return
+	}
+	if s.hanging {
+		time.Sleep(time.Second)
+		return
+	}
+	// like PAM, give the input time to arrive and flush it
+	time.Sleep(50 * time.Millisecond)
+	in.flush()
+	channel.Write([]byte("Password: "))
+	password, ok := in.readLine()
+	if !ok || password != s.password {
+		channel.Write([]byte("\r\nsu: Authentication failure\r\n"))
+		exit(1)
+		return
+	}
+	channel.Write([]byte("\r\nauthenticated\r\n"))
+	if strings.Contains(command, "read") {
+		line, _ := in.readLine()
+		channel.Write([]byte(line + "\r\n"))
+	}
+	exit(0)
+}
+
+func TestRunAsSu(t *testing.T) {
+	server := &suServer{password: "s'ecret"}
+	client, stop := server.start(t)
+	defer stop()
+	defer client.Close()
+	runAs := &RunAs{User: "wildfly", Method: RunAsSu, Password: "s'ecret"}
+
+	res, err := client.Run(context.Background(), Command{Cmd: "id", RunAs: runAs})
+	if err != nil || !res.Success() || !strings.Contains(res.Stdout, "authenticated") {
+		t.Errorf("su: %+v, %v", res, err)
+	}
+
+	res, err = client.Run(context.Background(), Command{Cmd: "read -r x && echo $x", Stdin: "input\n", RunAs: runAs})
+	if err != nil || !strings.Contains(res.Stdout, "authenticated\r\ninput") {
+		t.Errorf("su with input: %+v, %v", res, err)
+	}
+
+	wrong := &RunAs{User: "wildfly", Method: RunAsSu, Password: "guess"}
+	_, err = client.Run(context.Background(), Command{Cmd: "id", RunAs: wrong})
+	var privilegeErr *PrivilegeError
+	if !errors.As(err, &privilegeErr) || !errors.Is(err, ErrWrongPassword) {
+		t.Errorf("wrong password: %v", err)
+	}
+}
+
+func TestRunAsSuWithoutPrompt(t *testing.T) {
+	client, stop := (&suServer{silent: true}).start(t)
+	defer stop()
+	defer client.Close()
+	res, err := client.Run(context.Background(), Command{Cmd: "id", RunAs: &RunAs{User: "wildfly", Password: "pw"}})
+	if err != nil || !res.Success() || !strings.Contains(res.Stdout, "done") {
+		t.Errorf("su without a prompt: %+v, %v", res, err)
+	}
+
+	defer func(timeout time.Duration) { promptTimeout = timeout }(promptTimeout)
+	promptTimeout = 100 * time.Millisecond
+	client, stop = (&suServer{hanging: true}).start(t)
+	defer stop()
+	defer client.Close()
+	_, err = client.Run(context.Background(), Command{Cmd: "id", RunAs: &RunAs{User: "wildfly", Password: "pw"}})
+	if err == nil || !strings.Contains(err.Error(), `no "Password:" prompt`) {
+		t.Errorf("su never prompting: %v", err)
+	}
+}
+
+func TestRunAsWrap(t *testing.T) {
+	tests := []struct {
+		method string
+		line   string
+		stdin  string
+		pty    bool
+	}{
+		{RunAsSudo, `sudo -n -u 'wild fly' -- sh -c 'echo '\''x'\'''`, "in", false},
+		{RunAsSudoPassword, `sudo -S -p '[sudo password required]' -u 'wild fly' -- sh -c 'echo '\''x'\'''`, "pw\nin", false},
+		{RunAsSu, `LC_ALL=C su - 'wild fly' -c 'echo '\''x'\'''`, "pw\nin", true},
+		{"", `LC_ALL=C su - 'wild fly' -c 'echo '\''x'\'''`, "pw\nin", true},
+	}
+	for _, tt := range tests {
+		cmd, err := (&RunAs{User: "wild fly", Method: tt.method, Password: "pw"}).wrap(Command{Cmd: "echo 'x'", Stdin: "in"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cmd.Cmd != tt.line || cmd.Stdin != tt.stdin || cmd.Pty != tt.pty || cmd.RunAs != nil {
+			t.Errorf("%s: %+v", tt.method, cmd)
+		}
+	}
+	if _, err := (&RunAs{User: "u", Method: "doas"}).wrap(Command{Cmd: "id"}); err == nil {
+		t.Error("unknown method accepted")
+	}
+}
+
+func TestRunAsCheck(t *testing.T) {
+	tests := []struct {
+		method string
+		res    Result
+		want   error
+	}{
+		{RunAsSudo, Result{ExitCode: 1, Stderr: "sudo: a password is required\n"}, ErrPasswordRequired},
+		{RunAsSudoPassword, Result{ExitCode: 1, Stderr: "[sudo password required]Sorry, try again.\nsudo: 1 incorrect password attempt\n"}, ErrWrongPassword},
+		{RunAsSudoPassword, Result{ExitCode: 1, Stderr: "deploy is not in the sudoers file.  This incident will be reported.\n"}, ErrNotInSudoers},
+		{RunAsSudo, Result{ExitCode: 1, Stderr: "Sorry, user deploy is not allowed to execute '/bin/sh' as wildfly on app.\n"}, ErrNotInSudoers},
+		{RunAsSudoPassword, Result{ExitCode: 1, Stderr: "sudo: no password was provided\n"}, ErrPasswordRequired},
+		{RunAsSu, Result{ExitCode: 1, Stdout: "Password: \r\nsu: Authentication failure\r\n"}, ErrWrongPassword},
+		{"", Result{ExitCode: 1, Stdout: "Password: \r\nsu: Authentication failure\r\n"}, ErrWrongPassword},
+		{RunAsSu, Result{ExitCode: 2, Stdout: "Password: \r\ngrep: missing.log: No such file or directory\r\n"}, nil},
+		{RunAsSudo, Result{Stdout: "Sorry, try again"}, nil},
+	}
+	for _, tt := range tests {
+		err := (&RunAs{User: "wildfly", Method: tt.method}).check(tt.res)
+		if !errors.Is(err, tt.want) || (tt.want == nil) != (err == nil) {
+			t.Errorf("%s %+v: %v, want %v", tt.method, tt.res, err, tt.want)
+			continue
+		}
+		if err == nil {
+			continue
+		}
+		e := err.(*PrivilegeError)
+		if strings.Contains(e.Error(), sudoPrompt) || e.User != "wildfly" || (tt.method == "" && e.Method != RunAsSu) {
+			t.Errorf("%s: %+v", tt.method, e)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package sshConnection
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// DefaultMaxSessions is the session limit of a Client without MaxSessions.
+const DefaultMaxSessions = 10
+
+// Session is a session of the shared connection. Close frees its slot.
+type Session struct {
+	*ssh.Session
+	release sync.Once
+	slots   chan struct{}
+}
+
+func (s *Session) Close() error {
+	err := s.Session.Close()
+	s.release.Do(func() {
+		<-s.slots
+	})
+	return err
+}
+
+// Connect dials the remote host unless the client is already connected.
+// Connecting is optional, NewSession connects when needed.
+func (a *Client) Connect(ctx context.Context) error {
+	_, err := a.connection(ctx)
+	return err
+}
+
+func (a *Client) connection(ctx context.Context) (*ssh.Client, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.client != nil {
+		return a.client, nil
+	}
+	dial := a.dial
+	if a.connected {
+		dial = a.redial
+	}
+	client, jumps, err := dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	a.client, a.jumpClients, a.connected = client, jumps, true
+	go func() {
+		// the transport ended, the next session dials again
+		client.Wait()
+		a.drop(client)
+	}()
+	go a.keepAlive(client)
+	return client, nil
+}
+
+// drop forgets the connection if it is still the current one.
+func (a *Client) drop(client *ssh.Client) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.client != client {
+		return
+	}
+	client.Close()
+	closeClients(a.jumpClients)
+	a.client, a.jumpClients = nil, nil
+}
+
+// NewSession opens a session on the shared connection, connecting first if
+// needed. It waits while MaxSessions sessions are open. When the connection
+// turns out to be dead it is dropped and dialled again once.
+func (a *Client) NewSession(ctx context.Context) (*Session, error) {
+	a.mu.Lock()
+	if a.slots == nil {
+		max := a.MaxSessions
+		if max <= 0 {
+			max = DefaultMaxSessions
+		}
+		a.slots = make(chan struct{}, max)
+	}
+	slots := a.slots
+	a.mu.Unlock()
+	select {
+	case slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	session, err := a.newSession(ctx)
+	if err != nil {
+		<-slots
+		return nil, err
+	}
+	return &Session{Session: session, slots: slots}, nil
+}
+
+func (a *Client) newSession(ctx context.Context) (*ssh.Session, error) {
+	client, err := a.connection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	session, err := client.NewSession()
+	if err == nil {
+		return session, nil
+	}
+	if alive(client) {
+		return nil, fmt.Errorf("cannot open session on %s: %w", a.Host, err)
+	}
+	a.drop(client)
+	if client, err = a.connection(ctx); err != nil {
+		return nil, fmt.Errorf("reconnect: %w", err)
+	}
+	session, err = client.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("cannot open session on %s: %w", a.Host, err)
+	}
+	return session, nil
+}
+
+// alive reports whether the server still answers on the connection.
+func alive(client *ssh.Client) bool {
+	return ping(client, 15*time.Second) == nil
+}
+
+// Close closes the connection, the tunnels to it and the ssh-agent
+// connections. The client can be used again, it reconnects on the next
+// session.
+func (a *Client) Close() {
+	a.mu.Lock()
+	client := a.client
+	a.mu.Unlock()
+	if client != nil {
+		a.drop(client)
+	}
+	for _, agent := range a.agents {
+		agent.Close()
+	}
+}
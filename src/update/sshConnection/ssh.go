@@ -3,31 +3,67 @@ package sshConnection
 Author Bartosz Wołcerz
  */
 import (
-	"os/user"
-	"io/ioutil"
+	"context"
 	"fmt"
-	"encoding/pem"
-	"crypto/x509"
 	"io"
 	"sync"
+	"time"
+
 	"golang.org/x/crypto/ssh"
-	"log"
-	"strconv"
 )
 
 type ConnectionInt interface {
-	Execute(cmd Command) string
+	Execute(cmd Command) Result
 	IsSuccess() bool
-	Valid()
+	// Valid returns the error of the last executed command, a
+	// *RemoteCommandError when it exited with a non zero status.
+	Valid() error
 }
 type Command struct {
 	Cmd string
-}
+	// Secret marks commands that carry a password, e.g. the answer to a prompt.
+	Secret bool
+	// Stdin is fed to the command, with Pty through a terminal.
+	Stdin string
+	Pty   bool
+	// Prompt, with Pty, holds Stdin back until the output shows it.
+	Prompt string
+	// RunAs runs the command as another user.
+	RunAs *RunAs
+}
+// Client is one authenticated connection to the remote host, shared by all
+// the commands and transfers of a run. Each of them gets its own session,
+// see NewSession.
 type Client struct {
 	Host         string
 	ClientConfig *ssh.ClientConfig
-	Session      *ssh.Session
-	Conn         ssh.Conn
+	// Jumps are the jump hosts to the target, in connection order.
+	Jumps []Hop
+	// CommandTimeout limits every remote command, zero means no limit.
+	CommandTimeout time.Duration
+	// MaxSessions limits the sessions open at once, default
+	// DefaultMaxSessions like the MaxSessions of OpenSSH sshd.
+	MaxSessions int
+	// KeepAliveInterval is the time between keepalive requests, zero
+	// disables them. KeepAliveCountMax unanswered ones drop the connection.
+	KeepAliveInterval time.Duration
+	KeepAliveCountMax int
+	// ReconnectAttempts is how often a dropped connection is dialled again
+	// and an operation passed to Retry repeated, waiting ReconnectDelay
+	// (doubling) in between.
+	ReconnectAttempts int
+	ReconnectDelay    time.Duration
+
+	mu          sync.Mutex
+	client      *ssh.Client
+	jumpClients []*ssh.Client
+	slots       chan struct{}
+	// connected is set once the first connection succeeded, later dials are
+	// reconnects and retried.
+	connected bool
+	// agents are the ssh-agent connections of the auth methods, closed with
+	// the client.
+	agents []io.Closer
 }
 
 type ConnectionConfiguration struct {
@@ -35,210 +71,70 @@ type ConnectionConfiguration struct {
 	Password        string
 	Remote          bool
 	AddressWithPort string
-}
-type connectionChan struct {
-	in  chan<- string
-	out <-chan string
-}
-
-func (conn *connectionChan) Execute(cmd Command) string {
-	conn.in <- cmd.Cmd
-	fmt.Println(cmd.Cmd + " executed")
-	return <-conn.out
-}
-func (conn *connectionChan) IsSuccess() bool {
-	out := conn.Execute(Command{"echo $?"})
-	code, err := strconv.Atoi(out[:1])
-	return err == nil && code == 0
-}
-
-func (conn *connectionChan) Valid() {
-	if conn.IsSuccess() != true {
-		panic("Something went wrong")
-	}
-}
-func ReadPrivateKey(password string) ([]byte, error) {
-	usr, _ := user.Current()
-	path := usr.HomeDir + "/.ssh/id_rsa"
-	privateKey, err := ioutil.ReadFile(path)
-	if err != nil {
-		return nil, fmt.Errorf("failed to load identity: %v", err)
+	HostKey         HostKeyConfig
+	Auth            AuthConfig
+	// Jumps are the jump hosts to tunnel through, each with its own auth.
+	Jumps []ConnectionConfiguration
+}
+
+func GetSSHConnectionConfig(userConfig *ConnectionConfiguration) (*Client, error) {
+	var (
+		jumps  []Hop
+		agents []io.Closer
+	)
+	for i := range userConfig.Jumps {
+		jump, err := GetSSHConnectionConfig(&userConfig.Jumps[i])
+		if err != nil {
+			return nil, fmt.Errorf("jump host %s: %w", userConfig.Jumps[i].AddressWithPort, err)
+		}
+		jumps = append(jumps, Hop{Host: jump.Host, ClientConfig: jump.ClientConfig})
+		agents = append(agents, jump.agents...)
 	}
-
-	block, rest := pem.Decode(privateKey)
-	if len(rest) > 0 {
-		return nil, fmt.Errorf("extra data when decoding private key")
+	auth := userConfig.Auth
+	auth.Password = userConfig.Password
+	if len(auth.Methods) == 0 && !userConfig.Remote {
+		auth.Methods = []string{AuthPassword, AuthKeyboardInteractive}
 	}
-	if !x509.IsEncryptedPEMBlock(block) {
-		return privateKey, nil
+	if auth.KeyPassphrase == "" && userConfig.Remote {
+		auth.KeyPassphrase = userConfig.Password
 	}
-
-	passphrase := []byte (password)
-	der, err := x509.DecryptPEMBlock(block, passphrase)
+	method, agent, err := AuthMethods(auth)
 	if err != nil {
-		return nil, fmt.Errorf("decrypt failed: %v", err)
+		return nil, fmt.Errorf("cannot read ssh key: %w", err)
 	}
-
-	privateKey = pem.EncodeToMemory(&pem.Block{
-		Type:  block.Type,
-		Bytes: der,
-	})
-
-	return privateKey, nil
-}
-func muxShell(w io.Writer, r io.Reader) (chan<- string, <-chan string) {
-	in := make(chan string, 1)
-	out := make(chan string, 1)
-
-	var wg sync.WaitGroup
-	wg.Add(1) //for the shell itself
-
-	go func() {
-		for cmd := range in {
-
-			wg.Add(1)
-			w.Write([]byte(cmd + "\n"))
-			wg.Wait()
-		}
-	}()
-	go func() {
-		const bufSize = 65 * 1024
-		var (
-			buf [bufSize]byte
-			t   int
-		)
-		for {
-			if t == bufSize {
-				t = 0
-			}
-			n, err := r.Read(buf[t:])
-
-			if err != nil {
-				close(in)
-				close(out)
-				return
-			}
-			t += n
-			if t >= bufSize {
-				t = bufSize
-			}
-			if buf[t-2] == '$' || buf[t-2] == ':' { //assuming the $PS1 == '$ ' or passwords == ': '
-				out <- string(buf[:t])
-				t = 0
-				wg.Done()
-			}
-		}
-	}()
-	return in, out
-}
-
-// Connects to the remote SSH server, returns error if it couldn't establish a session to the SSH server
-func (a *Client) Connect() error {
-	client, err := ssh.Dial("tcp", a.Host, a.ClientConfig)
-	if err != nil {
-		return err
+	if agent != nil {
+		agents = append(agents, agent)
 	}
-
-	a.Conn = client.Conn
-	a.Session, err = client.NewSession()
+	hostKeyCallback, err := HostKeyCallback(userConfig.HostKey)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("cannot verify host keys: %w", err)
 	}
-	return nil
-}
-
-func GetSSHConnectionConfig(userConfig *ConnectionConfiguration) (Client) {
-	method := make([]ssh.AuthMethod, 1)
-	if userConfig.Remote {
-		per, err := ReadPrivateKey(userConfig.Password)
-		if err != nil {
-			panic("Cannot read ssh key" + err.Error())
-		}
-		key, err := ssh.ParsePrivateKey(per)
-		if err != nil {
-			panic("Cannot read ssh key" + err.Error())
-		}
-		method[0] = ssh.PublicKeys(key)
-	} else {
-		method[0] = ssh.Password(userConfig.Password)
+	algorithms, err := HostKeyAlgorithms(userConfig.HostKey, userConfig.AddressWithPort)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read known hosts: %w", err)
 	}
 	config := ssh.ClientConfig{
-		User:            userConfig.User,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		Auth:            method,
+		User:              userConfig.User,
+		HostKeyCallback:   hostKeyCallback,
+		HostKeyAlgorithms: algorithms,
+		Auth:              method,
 	}
-	return Client{ClientConfig: &config, Host: userConfig.AddressWithPort}
+	return &Client{ClientConfig: &config, Host: userConfig.AddressWithPort, Jumps: jumps, agents: agents}, nil
 }
-func (client *Client) RunCommands(getCmds func(con ConnectionInt, params map[string]string) []func(), parameters map[string]string) {
-	session := client.Session
-	//defer session.Close()
-	//var b bytes.Buffer
-	//session.Stdout = &b
-	//
-	//if err := session.Run("/usr/bin/ls"); err != nil {
-	//	panic("Failed to run: " + err.Error())
-	//}
-	//fmt.Println(b.String())
-	modes := ssh.TerminalModes{
-		ssh.ECHO:          0,     // disable echoing
-		ssh.TTY_OP_ISPEED: 14400, // input speed = 14.4kbaud
-		ssh.TTY_OP_OSPEED: 14400, // output speed = 14.4kbaud
-	}
-
-	if err := session.RequestPty("xterm", 80, 40, modes); err != nil {
-		log.Fatal(err)
-	}
-
-	w, err := session.StdinPipe()
-	if err != nil {
-		panic(err)
-	}
-	r, err := session.StdoutPipe()
-	if err != nil {
-		panic(err)
-	}
-	in, out := muxShell(w, r)
-	if err := session.Start("/bin/bash"); err != nil {
-		log.Fatal(err)
-	}
-	<-out //ignore the shell output
-
-	conn := connectionChan{in, out}
-	commands := getCmds(&conn, parameters)
-	run(commands)
-	session.Wait()
+// RunCommands runs the commands on the connected client, each command in its
+// own session, and stops at the first one returning an error. Once ctx is
+// done the running command is killed and the rest fail.
+func (client *Client) RunCommands(ctx context.Context, getCmds func(con ConnectionInt) []func() error) error {
+	conn := connectionExec{ctx: ctx, client: client}
+	commands := getCmds(&conn)
+	return run(commands)
 }
 
-func run(commands []func()) {
+func run(commands []func() error) error {
 	for _, i := range commands {
-		i()
-	}
-}
-func GetClient(parameters map[string]string) Client {
-
-	conf := ConnectionConfiguration{
-		Password:        parameters["remote-host-user-password"],
-		Remote:          parameters["use-key"] == "true" || parameters["useKey"] == "TRUE",
-		User:            parameters["remote-host-user"],
-		AddressWithPort: parameters["remote-addr"] + ":" + parameters["remote-port"]}
-	client := GetSSHConnectionConfig(&conf)
-	return client
-}
-
-func (a *Client) Close() {
-	a.Session.Close()
-	a.Conn.Close()
-}
-func getKeyFile() (key ssh.Signer, err error) {
-	usr, _ := user.Current()
-	file := usr.HomeDir + "/.ssh/id_rsa"
-	buf, err := ioutil.ReadFile(file)
-	if err != nil {
-		return
-	}
-	key, err = ssh.ParsePrivateKey(buf)
-	if err != nil {
-		return
+		if err := i(); err != nil {
+			return err
+		}
 	}
-	return
+	return nil
 }
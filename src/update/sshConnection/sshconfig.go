@@ -0,0 +1,174 @@
+package sshConnection
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+)
+
+// HostConfig is the part of an OpenSSH client config (~/.ssh/config) entry
+// used by the tool.
+type HostConfig struct {
+	HostName      string
+	Port          string
+	User          string
+	IdentityFiles []string
+	ProxyJump     string
+}
+
+// LookupSSHConfig reads the OpenSSH client config at path and returns the
+// settings applying to alias. As in ssh the first value found for a keyword
+// wins, IdentityFile values accumulate. Missing identity files of blocks not
+// naming the host, like Host *, are left out since those apply to every host.
+// Match blocks are not supported and skipped. A missing file gives an empty
+// HostConfig.
+func LookupSSHConfig(path, alias string) (HostConfig, error) {
+	host := HostConfig{}
+	if err := readSSHConfig(path, alias, &host, 0, true); err != nil {
+		return host, err
+	}
+	if host.HostName != "" {
+		host.HostName = strings.Replace(host.HostName, "%h", alias, -1)
+	}
+	return host, nil
+}
+
+// readSSHConfig reads one config file, generic tells whether the block
+// including it applies to the host through wildcards only.
+func readSSHConfig(path, alias string, host *HostConfig, depth int, generic bool) error {
+	if depth > 8 {
+		return fmt.Errorf("ssh config %s: too many nested includes", path)
+	}
+	f, err := os.Open(expandHome(path))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot read ssh config: %v", err)
+	}
+	defer f.Close()
+
+	matching := true
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		keyword, args := splitSSHConfigLine(scanner.Text())
+		if keyword == "" {
+			continue
+		}
+		switch keyword {
+		case "host":
+			matching = matchHost(alias, args)
+			generic = !namesHost(alias, args)
+			continue
+		case "match":
+			matching = false
+			continue
+		}
+		if !matching || len(args) == 0 {
+			continue
+		}
+		switch keyword {
+		case "include":
+			for _, pattern := range args {
+				pattern = expandHome(pattern)
+				if !filepath.IsAbs(pattern) {
+					pattern = filepath.Join(expandHome("~/.ssh"), pattern)
+				}
+				files, _ := filepath.Glob(pattern)
+				for _, file := range files {
+					if err := readSSHConfig(file, alias, host, depth+1, generic); err != nil {
+						return err
+					}
+				}
+			}
+		case "hostname":
+			setFirst(&host.HostName, args[0])
+		case "port":
+			setFirst(&host.Port, args[0])
+		case "user":
+			setFirst(&host.User, args[0])
+		case "proxyjump":
+			if args[0] != "none" {
+				setFirst(&host.ProxyJump, args[0])
+			}
+		case "identityfile":
+			file := expandHome(args[0])
+			if _, err := os.Stat(file); os.IsNotExist(err) && generic {
+				continue
+			}
+			host.IdentityFiles = append(host.IdentityFiles, file)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("cannot read ssh config: %v", err)
+	}
+	return nil
+}
+
+func setFirst(field *string, value string) {
+	if *field == "" {
+		*field = value
+	}
+}
+
+// splitSSHConfigLine returns the lower case keyword and its arguments. Both
+// "Keyword value" and "Keyword=value" forms are accepted.
+func splitSSHConfigLine(line string) (string, []string) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", nil
+	}
+	i := strings.IndexAny(line, " \t=")
+	if i < 0 {
+		return strings.ToLower(line), nil
+	}
+	keyword := strings.ToLower(line[:i])
+	rest := strings.TrimLeft(line[i:], " \t")
+	rest = strings.TrimLeft(strings.TrimPrefix(rest, "="), " \t")
+	var args []string
+	for _, arg := range strings.Fields(rest) {
+		args = append(args, strings.Trim(arg, `"`))
+	}
+	return keyword, args
+}
+
+// matchHost reports whether alias matches the Host patterns, ignoring case as
+// ssh does. A matching negated pattern (!pattern) excludes the host.
+func matchHost(alias string, patterns []string) bool {
+	alias = strings.ToLower(alias)
+	matched := false
+	for _, pattern := range patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		ok, _ := filepath.Match(strings.ToLower(strings.TrimPrefix(pattern, "!")), alias)
+		if ok && negated {
+			return false
+		}
+		matched = matched || ok
+	}
+	return matched
+}
+
+// namesHost reports whether one of the patterns is alias itself rather than a
+// wildcard matching it.
+func namesHost(alias string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if strings.EqualFold(pattern, alias) {
+			return true
+		}
+	}
+	return false
+}
+
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	usr, err := user.Current()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(usr.HomeDir, path[1:])
+}
@@ -0,0 +1,121 @@
+package sshConnection
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMatchHost(t *testing.T) {
+	tests := []struct {
+		alias    string
+		patterns string
+		want     bool
+	}{
+		{"prod", "prod", true},
+		{"prod", "stage prod", true},
+		{"prod", "stage", false},
+		{"Prod", "prod", true},
+		{"prod", "PROD", true},
+		{"app1.example.com", "*.example.com", true},
+		{"app1.EXAMPLE.com", "*.example.com", true},
+		{"app1.example.org", "*.example.com", false},
+		{"app1", "app?", true},
+		{"app12", "app?", false},
+		{"prod", "* !prod", false},
+		{"stage", "* !prod", true},
+		{"prod", "!prod", false},
+		{"prod", "*", true},
+	}
+	for _, tt := range tests {
+		if got := matchHost(tt.alias, strings.Fields(tt.patterns)); got != tt.want {
+			t.Errorf("matchHost(%q, %q) = %v, want %v", tt.alias, tt.patterns, got, tt.want)
+		}
+	}
+}
+
+func TestLookupSSHConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key := filepath.Join(dir, "id_prod")
+	if err := ioutil.WriteFile(key, []byte("key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	write := func(name, content string) string {
+		file := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(file, []byte(strings.Replace(content, "DIR", dir, -1)), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+	write("included", `
+Host included
+  HostName 10.0.0.9
+  User included
+Host *
+  Port 2022
+`)
+	config := write("config", `
+# the first value wins
+Host prod PROD-alias
+  HostName 10.0.0.1
+  User deploy
+  IdentityFile DIR/id_prod
+  IdentityFile DIR/id_missing
+Host prod
+  HostName 10.0.0.2
+  Port 2200
+Host *.example.com !bad.example.com
+  HostName %h
+  User=web
+  ProxyJump bastion
+Match host prod
+  User matched
+Host *
+  Include DIR/includ*
+  User fallback
+  IdentityFile DIR/id_default
+  IdentityFile DIR/id_prod
+`)
+
+	tests := []struct {
+		alias string
+		want  HostConfig
+	}{
+		{"prod", HostConfig{HostName: "10.0.0.1", Port: "2200", User: "deploy",
+			IdentityFiles: []string{filepath.Join(dir, "id_prod"), filepath.Join(dir, "id_missing"), filepath.Join(dir, "id_prod")}}},
+		{"prod-alias", HostConfig{HostName: "10.0.0.1", Port: "2022", User: "deploy",
+			IdentityFiles: []string{filepath.Join(dir, "id_prod"), filepath.Join(dir, "id_missing"), filepath.Join(dir, "id_prod")}}},
+		{"app.example.com", HostConfig{HostName: "app.example.com", Port: "2022", User: "web", ProxyJump: "bastion",
+			IdentityFiles: []string{filepath.Join(dir, "id_prod")}}},
+		{"bad.example.com", HostConfig{Port: "2022", User: "fallback",
+			IdentityFiles: []string{filepath.Join(dir, "id_prod")}}},
+		{"included", HostConfig{HostName: "10.0.0.9", Port: "2022", User: "included",
+			IdentityFiles: []string{filepath.Join(dir, "id_prod")}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.alias, func(t *testing.T) {
+			got, err := LookupSSHConfig(config, tt.alias)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	if got, err := LookupSSHConfig(filepath.Join(dir, "none"), "prod"); err != nil || !reflect.DeepEqual(got, HostConfig{}) {
+		t.Errorf("missing config: %+v, %v", got, err)
+	}
+	loop := write("loop", "Include DIR/loop\n")
+	if _, err := LookupSSHConfig(loop, "prod"); err == nil || !strings.Contains(err.Error(), "too many nested includes") {
+		t.Errorf("include loop: %v", err)
+	}
+}
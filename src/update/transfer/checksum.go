@@ -0,0 +1,88 @@
+package transfer
+
+import (
+	"../sshConnection"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// ErrChecksum matches every *ChecksumError.
+var ErrChecksum = errors.New("checksum mismatch")
+
+// ChecksumError is a transferred file whose remote SHA-256 digest differs
+// from the local one.
+type ChecksumError struct {
+	Path   string
+	Local  string
+	Remote string
+}
+
+func (e *ChecksumError) Error() string {
+	return "checksum mismatch for " + e.Path + ": sha256 " + e.Local + " locally, " + e.Remote + " on the remote host"
+}
+
+func (e *ChecksumError) Is(target error) bool {
+	return target == ErrChecksum
+}
+
+// Verify compares the SHA-256 digests of localFile and remoteFile after a
+// transfer and returns the digest, a *ChecksumError when they differ.
+func Verify(ctx context.Context, t Transferer, localFile, remoteFile string) (string, error) {
+	local, err := FileSHA256(localFile)
+	if err != nil {
+		return "", err
+	}
+	remote, err := t.Checksum(ctx, remoteFile)
+	if err != nil {
+		return "", err
+	}
+	if local != remote {
+		return "", &ChecksumError{Path: remoteFile, Local: local, Remote: remote}
+	}
+	return local, nil
+}
+
+// FileSHA256 returns the hex encoded SHA-256 digest of a local file.
+func FileSHA256(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return digest(f)
+}
+
+func digest(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// remoteSHA256 runs sha256sum on the remote host. The file is given on stdin
+// so the output is not escaped for unusual names.
+func remoteSHA256(ctx context.Context, client *sshConnection.Client, remoteFile string) (string, error) {
+	cmd := "sha256sum < " + sshConnection.ShellQuote(remoteFile)
+	res, err := client.Run(ctx, sshConnection.Command{Cmd: cmd})
+	if err != nil {
+		return "", err
+	}
+	if !res.Success() {
+		return "", &sshConnection.RemoteCommandError{Cmd: cmd, ExitCode: res.ExitCode, Stderr: res.Stderr}
+	}
+	fields := strings.Fields(res.Stdout)
+	if len(fields) == 0 || len(fields[0]) != sha256.Size*2 {
+		return "", fmt.Errorf("unexpected sha256sum output %q", res.Stdout)
+	}
+	if _, err := hex.DecodeString(fields[0]); err != nil {
+		return "", fmt.Errorf("unexpected sha256sum output %q", res.Stdout)
+	}
+	return strings.ToLower(fields[0]), nil
+}
@@ -0,0 +1,217 @@
+package transfer
+
+import (
+	"../progress"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/pkg/sftp"
+)
+
+// localEntries lists what is copied of the local directory dir: files and
+// subdirectories. Symbolic links to files are followed, links to directories
+// and special files are left out, like scp does.
+func localEntries(dir string) ([]os.FileInfo, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var copied []os.FileInfo
+	for _, entry := range entries {
+		if entry.Mode()&os.ModeSymlink != 0 {
+			if entry, err = os.Stat(filepath.Join(dir, entry.Name())); err != nil {
+				return nil, err
+			}
+			if entry.IsDir() {
+				continue
+			}
+		}
+		if entry.IsDir() || entry.Mode().IsRegular() {
+			copied = append(copied, entry)
+		}
+	}
+	return copied, nil
+}
+
+// ResumeUploadDir uploads the local directory localDir to remoteDir file by
+// file with ResumeUpload, so an interrupted upload continues with the partial
+// file it left. Modification times are not kept.
+func ResumeUploadDir(ctx context.Context, t Transferer, localDir, remoteDir string) error {
+	if err := t.Mkdir(ctx, remoteDir); err != nil {
+		return err
+	}
+	entries, err := localEntries(localDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		local, remote := filepath.Join(localDir, entry.Name()), path.Join(remoteDir, entry.Name())
+		if entry.IsDir() {
+			err = ResumeUploadDir(ctx, t, local, remote)
+		} else {
+			err = t.ResumeUpload(ctx, local, remote)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// VerifyDir runs Verify for every file uploaded from localDir to remoteDir and
+// returns their digests by remote path.
+func VerifyDir(ctx context.Context, t Transferer, localDir, remoteDir string) (map[string]string, error) {
+	digests := map[string]string{}
+	entries, err := localEntries(localDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		local, remote := filepath.Join(localDir, entry.Name()), path.Join(remoteDir, entry.Name())
+		if entry.IsDir() {
+			sub, err := VerifyDir(ctx, t, local, remote)
+			if err != nil {
+				return nil, err
+			}
+			for file, sum := range sub {
+				digests[file] = sum
+			}
+			continue
+		}
+		sum, err := Verify(ctx, t, local, remote)
+		if err != nil {
+			return nil, err
+		}
+		digests[remote] = sum
+	}
+	return digests, nil
+}
+
+// UploadDir copies the tree over one sftp session, modes (perm for files when
+// set) and modification times are set after the content.
+func (t *sftpTransfer) UploadDir(ctx context.Context, localDir, remoteDir string) error {
+	err := t.session(ctx, func(c *sftp.Client) error {
+		info, err := os.Stat(localDir)
+		if err != nil {
+			return err
+		}
+		return uploadTree(ctx, c, localDir, remoteDir, info, t.perm)
+	})
+	return wrap("write", remoteDir, err)
+}
+
+func uploadTree(ctx context.Context, c *sftp.Client, local, remote string, info os.FileInfo, perm os.FileMode) error {
+	mode := info.Mode().Perm()
+	if !info.IsDir() {
+		if err := uploadFile(ctx, c, local, remote); err != nil {
+			return err
+		}
+		mode = filePerm(perm, info)
+	} else {
+		if err := c.MkdirAll(remote); err != nil {
+			return err
+		}
+		entries, err := localEntries(local)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := uploadTree(ctx, c, filepath.Join(local, entry.Name()), path.Join(remote, entry.Name()), entry, perm); err != nil {
+				return err
+			}
+		}
+	}
+	if err := c.Chmod(remote, mode); err != nil {
+		return err
+	}
+	return c.Chtimes(remote, info.ModTime(), info.ModTime())
+}
+
+func uploadFile(ctx context.Context, c *sftp.Client, local, remote string) error {
+	in, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := c.Create(remote)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, upload(ctx, in, remote)); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// DownloadDir copies the remote tree over one sftp session, modes and
+// modification times are kept.
+func (t *sftpTransfer) DownloadDir(ctx context.Context, remoteDir, localDir string) error {
+	err := t.session(ctx, func(c *sftp.Client) error {
+		info, err := c.Stat(remoteDir)
+		if err != nil {
+			return err
+		}
+		return downloadTree(ctx, c, remoteDir, localDir, info)
+	})
+	return wrap("read", remoteDir, err)
+}
+
+func downloadTree(ctx context.Context, c *sftp.Client, remote, local string, info os.FileInfo) error {
+	if !info.IsDir() {
+		if err := downloadFile(ctx, c, remote, local, info.Size()); err != nil {
+			return err
+		}
+	} else {
+		// writable until its content is there
+		if err := os.Mkdir(local, 0700); err != nil && !os.IsExist(err) {
+			return err
+		}
+		entries, err := c.ReadDir(remote)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			p := path.Join(remote, entry.Name())
+			if entry.Mode()&os.ModeSymlink != 0 {
+				if entry, err = c.Stat(p); err != nil {
+					return err
+				}
+				if entry.IsDir() {
+					continue
+				}
+			}
+			if !entry.IsDir() && !entry.Mode().IsRegular() {
+				continue
+			}
+			if err := downloadTree(ctx, c, p, filepath.Join(local, path.Base(p)), entry); err != nil {
+				return err
+			}
+		}
+	}
+	if err := os.Chmod(local, info.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Chtimes(local, info.ModTime(), info.ModTime())
+}
+
+func downloadFile(ctx context.Context, c *sftp.Client, remote, local string, size int64) error {
+	in, err := c.Open(remote)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(local, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(progress.Writer(ctx, out, "download "+remote, size), in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
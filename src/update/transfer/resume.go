@@ -0,0 +1,71 @@
+package transfer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// PartSuffix is appended to the remote name while an upload is in progress,
+// the file gets its name once complete.
+const PartSuffix = ".part"
+
+// resumeOffset returns how much of localFile the partial remote file part
+// already holds. It is 0 when there is no partial file or its size or SHA-256
+// digest do not match the start of localFile.
+func resumeOffset(ctx context.Context, t Transferer, localFile, part string) (int64, error) {
+	info, err := t.Stat(ctx, part)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	local, err := os.Stat(localFile)
+	if err != nil {
+		return 0, err
+	}
+	size := info.Size()
+	if size == 0 || size > local.Size() {
+		return 0, nil
+	}
+	remote, err := t.Checksum(ctx, part)
+	if err != nil {
+		return 0, err
+	}
+	prefix, err := prefixSHA256(localFile, size)
+	if err != nil {
+		return 0, err
+	}
+	if prefix != remote {
+		fmt.Println("Partial upload " + part + " differs from " + localFile + ", sending it again")
+		return 0, nil
+	}
+	fmt.Printf("Resuming upload of %s at %d of %d bytes\n", localFile, size, local.Size())
+	return size, nil
+}
+
+// prefixSHA256 returns the digest of the first size bytes of a local file.
+func prefixSHA256(file string, size int64) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return digest(io.LimitReader(f, size))
+}
+
+// openAt opens a local file positioned at offset.
+func openAt(file string, offset int64) (*os.File, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
@@ -0,0 +1,227 @@
+package transfer
+
+import (
+	"../progress"
+	"../scp"
+	"../sshConnection"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// scpTransfer copies with the scp program of the host, the other operations
+// are shell commands.
+type scpTransfer struct {
+	client *sshConnection.Client
+	perm   os.FileMode
+}
+
+// Upload sets the permissions perm, or those of localFile, warnings of the
+// remote scp are printed.
+func (t *scpTransfer) Upload(ctx context.Context, localFile, remoteFile string) error {
+	warnings, err := scp.CopyLocalToRemote(ctx, t.client, localFile, remoteFile, t.perm)
+	if err == nil {
+		for _, w := range warnings {
+			fmt.Println("scp warning: " + w)
+		}
+	}
+	return err
+}
+
+// ResumeUpload sends a new file with scp, the protocol has no offsets so the
+// rest of a partial file is appended by cat on the remote host. The
+// permissions are set again before the file is renamed, scp keeps those of a
+// stale partial file it overwrites and cat those of a continued one.
+func (t *scpTransfer) ResumeUpload(ctx context.Context, localFile, remoteFile string) error {
+	part := remoteFile + PartSuffix
+	offset, err := resumeOffset(ctx, t, localFile, part)
+	if err != nil {
+		return err
+	}
+	if offset == 0 {
+		err = t.Upload(ctx, localFile, part)
+	} else {
+		err = t.append(ctx, localFile, part, offset)
+	}
+	if err != nil {
+		return err
+	}
+	cmd := "mv -f -- " + sshConnection.ShellQuote(part) + " " + sshConnection.ShellQuote(remoteFile)
+	if t.perm != 0 {
+		cmd = fmt.Sprintf("chmod %04o -- %s && %s", t.perm, sshConnection.ShellQuote(part), cmd)
+	}
+	if _, err := t.run(ctx, cmd); err != nil {
+		return &scp.TransferError{Op: "write", Path: remoteFile, Err: err}
+	}
+	return nil
+}
+
+// append streams localFile from offset to the end of the remote file.
+func (t *scpTransfer) append(ctx context.Context, localFile, remoteFile string, offset int64) error {
+	err := func() error {
+		in, err := openAt(localFile, offset)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		s, err := t.client.NewSession(ctx)
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+		info, err := in.Stat()
+		if err != nil {
+			return err
+		}
+		s.Stdin = progress.Reader(ctx, in, "upload "+remoteFile, info.Size()-offset)
+		stop := sshConnection.Interrupt(ctx, s)
+		err = s.Run("cat >> " + sshConnection.ShellQuote(remoteFile))
+		if stop() {
+			return ctx.Err()
+		}
+		return err
+	}()
+	if err != nil {
+		return &scp.TransferError{Op: "write", Path: remoteFile, Err: err}
+	}
+	return nil
+}
+
+func (t *scpTransfer) Download(ctx context.Context, remoteFile, localFile string) error {
+	in, err := scp.Read(ctx, t.client, remoteFile)
+	if err != nil {
+		return err
+	}
+	out, err := os.Create(localFile)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// UploadDir sends the tree with the directory records of scp, its files with
+// the permissions perm when set. Warnings of the remote scp are printed.
+func (t *scpTransfer) UploadDir(ctx context.Context, localDir, remoteDir string) error {
+	warnings, err := scp.CopyDirToRemote(ctx, t.client, localDir, remoteDir, t.perm)
+	if err == nil {
+		for _, w := range warnings {
+			fmt.Println("scp warning: " + w)
+		}
+	}
+	return err
+}
+
+func (t *scpTransfer) DownloadDir(ctx context.Context, remoteDir, localDir string) error {
+	return scp.CopyRemoteToLocal(ctx, t.client, remoteDir, localDir)
+}
+
+// Stat runs stat(1), it gives size, raw mode in hex and mtime.
+func (t *scpTransfer) Stat(ctx context.Context, remoteFile string) (os.FileInfo, error) {
+	out, err := t.run(ctx, "stat -L -c '%s %f %Y' -- "+sshConnection.ShellQuote(remoteFile))
+	if err != nil {
+		if strings.Contains(err.Error(), "No such file") {
+			return nil, &scp.TransferError{Op: "stat", Path: remoteFile, Err: os.ErrNotExist}
+		}
+		return nil, &scp.TransferError{Op: "stat", Path: remoteFile, Err: err}
+	}
+	var size, mtime int64
+	var rawMode string
+	if _, err := fmt.Sscan(out, &size, &rawMode, &mtime); err != nil {
+		return nil, &scp.TransferError{Op: "stat", Path: remoteFile, Err: fmt.Errorf("unexpected stat output %q", out)}
+	}
+	mode, err := strconv.ParseUint(rawMode, 16, 32)
+	if err != nil {
+		return nil, &scp.TransferError{Op: "stat", Path: remoteFile, Err: err}
+	}
+	return &fileInfo{
+		name:    path.Base(remoteFile),
+		size:    size,
+		mode:    unixMode(uint32(mode)),
+		modTime: time.Unix(mtime, 0),
+	}, nil
+}
+
+func (t *scpTransfer) Remove(ctx context.Context, remoteFile string) error {
+	if _, err := t.run(ctx, "rm -- "+sshConnection.ShellQuote(remoteFile)); err != nil {
+		return &scp.TransferError{Op: "remove", Path: remoteFile, Err: err}
+	}
+	return nil
+}
+
+func (t *scpTransfer) Mkdir(ctx context.Context, remoteDir string) error {
+	if _, err := t.run(ctx, "mkdir -p -- "+sshConnection.ShellQuote(remoteDir)); err != nil {
+		return &scp.TransferError{Op: "mkdir", Path: remoteDir, Err: err}
+	}
+	return nil
+}
+
+func (t *scpTransfer) Checksum(ctx context.Context, remoteFile string) (string, error) {
+	sum, err := remoteSHA256(ctx, t.client, remoteFile)
+	if err != nil {
+		return "", &scp.TransferError{Op: "checksum", Path: remoteFile, Err: err}
+	}
+	return sum, nil
+}
+
+func (t *scpTransfer) run(ctx context.Context, cmd string) (string, error) {
+	res, err := t.client.Run(ctx, sshConnection.Command{Cmd: cmd})
+	if err != nil {
+		return "", err
+	}
+	if !res.Success() {
+		return "", &sshConnection.RemoteCommandError{Cmd: cmd, ExitCode: res.ExitCode, Stderr: res.Stderr}
+	}
+	return res.Stdout, nil
+}
+
+type fileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (f *fileInfo) Name() string       { return f.name }
+func (f *fileInfo) Size() int64        { return f.size }
+func (f *fileInfo) Mode() os.FileMode  { return f.mode }
+func (f *fileInfo) ModTime() time.Time { return f.modTime }
+func (f *fileInfo) IsDir() bool        { return f.mode.IsDir() }
+func (f *fileInfo) Sys() interface{}   { return nil }
+
+// unixMode converts st_mode to os.FileMode.
+func unixMode(mode uint32) os.FileMode {
+	m := os.FileMode(mode & 0777)
+	switch mode & 0170000 {
+	case 0040000:
+		m |= os.ModeDir
+	case 0120000:
+		m |= os.ModeSymlink
+	case 0010000:
+		m |= os.ModeNamedPipe
+	case 0140000:
+		m |= os.ModeSocket
+	case 0020000:
+		m |= os.ModeDevice | os.ModeCharDevice
+	case 0060000:
+		m |= os.ModeDevice
+	}
+	if mode&04000 != 0 {
+		m |= os.ModeSetuid
+	}
+	if mode&02000 != 0 {
+		m |= os.ModeSetgid
+	}
+	if mode&01000 != 0 {
+		m |= os.ModeSticky
+	}
+	return m
+}
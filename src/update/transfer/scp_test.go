@@ -0,0 +1,156 @@
+package transfer
+
+import (
+	"../sshConnection"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// shellServer is an ssh server running every command with the local sh, so
+// the scp transfer works on local files. It returns a client of the server
+// and a function stopping it.
+func shellServer(t *testing.T) (*sshConnection.Client, func()) {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(signer)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveShell(conn, config)
+		}
+	}()
+	client := &sshConnection.Client{Host: l.Addr().String(), ClientConfig: &ssh.ClientConfig{
+		User:            "deploy",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}}
+	return client, func() {
+		client.Close()
+		l.Close()
+	}
+}
+
+func serveShell(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for newChannel := range chans {
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range requests {
+				if req.Type != "exec" {
+					req.Reply(false, nil)
+					continue
+				}
+				var exec struct{ Command string }
+				ssh.Unmarshal(req.Payload, &exec)
+				req.Reply(true, nil)
+				go runShell(channel, exec.Command)
+			}
+		}()
+	}
+}
+
+func runShell(channel ssh.Channel, command string) {
+	defer channel.Close()
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdout = channel
+	cmd.Stderr = channel.Stderr()
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return
+	}
+	go func() {
+		io.Copy(stdin, channel)
+		stdin.Close()
+	}()
+	status := uint32(0)
+	if err := cmd.Run(); err != nil {
+		status = 1
+		if exit, ok := err.(*exec.ExitError); ok {
+			status = uint32(exit.ExitCode())
+		}
+	}
+	channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+}
+
+func TestScpResumeUploadPermissions(t *testing.T) {
+	client, stop := shellServer(t)
+	defer stop()
+	content := strings.Repeat("ear content ", 1000)
+	tests := []struct {
+		name string
+		part string
+	}{
+		{"no partial file", ""},
+		{"stale partial file", "other content"},
+		{"partial file", content[:100]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "transfer")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			local := filepath.Join(dir, "app.ear")
+			remote := filepath.Join(dir, "remote.ear")
+			if err := ioutil.WriteFile(local, []byte(content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if tt.part != "" {
+				if err := ioutil.WriteFile(remote+PartSuffix, []byte(tt.part), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			tr := &scpTransfer{client: client, perm: 0644}
+			if err := tr.ResumeUpload(context.Background(), local, remote); err != nil {
+				t.Fatal(err)
+			}
+			data, err := ioutil.ReadFile(remote)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != content {
+				t.Errorf("uploaded %d bytes, want %d", len(data), len(content))
+			}
+			if info, err := os.Stat(remote); err != nil || info.Mode().Perm() != 0644 {
+				t.Errorf("mode %v, %v; want 0644", info.Mode(), err)
+			}
+			if _, err := os.Stat(remote + PartSuffix); !os.IsNotExist(err) {
+				t.Errorf("partial file left: %v", err)
+			}
+		})
+	}
+}
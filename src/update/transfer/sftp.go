@@ -0,0 +1,229 @@
+package transfer
+
+import (
+	"../progress"
+	"../sshConnection"
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/pkg/sftp"
+)
+
+// sftpTransfer uses the sftp subsystem, every operation on its own session.
+type sftpTransfer struct {
+	client *sshConnection.Client
+	perm   os.FileMode
+}
+
+// session starts the sftp subsystem and runs f with a client on it. The
+// session is closed when ctx is done, which fails the running operation.
+func (t *sftpTransfer) session(ctx context.Context, f func(c *sftp.Client) error) error {
+	s, err := t.client.NewSession(ctx)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	stop := sshConnection.Interrupt(ctx, s)
+	defer stop()
+	w, err := s.StdinPipe()
+	if err != nil {
+		return err
+	}
+	r, err := s.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := s.RequestSubsystem("sftp"); err != nil {
+		return fmt.Errorf("%w: sftp: %v", ErrUnsupported, err)
+	}
+	c, err := sftp.NewClientPipe(r, w)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if err := f(c); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	return nil
+}
+
+func (t *sftpTransfer) probe(ctx context.Context) error {
+	return t.session(ctx, func(c *sftp.Client) error {
+		return nil
+	})
+}
+
+// Upload sets the permissions perm, or those of localFile.
+func (t *sftpTransfer) Upload(ctx context.Context, localFile, remoteFile string) error {
+	err := t.session(ctx, func(c *sftp.Client) error {
+		in, err := os.Open(localFile)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		info, err := in.Stat()
+		if err != nil {
+			return err
+		}
+		out, err := c.Create(remoteFile)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(out, upload(ctx, in, remoteFile)); err != nil {
+			out.Close()
+			return err
+		}
+		if err := out.Close(); err != nil {
+			return err
+		}
+		return c.Chmod(remoteFile, filePerm(t.perm, info))
+	})
+	return wrap("write", remoteFile, err)
+}
+
+// ResumeUpload writes the rest of localFile at the offset of the partial
+// file and renames it when complete, with the permissions of Upload.
+func (t *sftpTransfer) ResumeUpload(ctx context.Context, localFile, remoteFile string) error {
+	part := remoteFile + PartSuffix
+	offset, err := resumeOffset(ctx, t, localFile, part)
+	if err != nil {
+		return err
+	}
+	err = t.session(ctx, func(c *sftp.Client) error {
+		in, err := openAt(localFile, offset)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		flags := os.O_WRONLY | os.O_CREATE
+		if offset == 0 {
+			flags |= os.O_TRUNC
+		}
+		out, err := c.OpenFile(part, flags)
+		if err != nil {
+			return err
+		}
+		if _, err := out.Seek(offset, io.SeekStart); err != nil {
+			out.Close()
+			return err
+		}
+		if _, err := io.Copy(out, upload(ctx, in, remoteFile)); err != nil {
+			out.Close()
+			return err
+		}
+		if err := out.Close(); err != nil {
+			return err
+		}
+		info, err := in.Stat()
+		if err != nil {
+			return err
+		}
+		if err := c.Chmod(part, filePerm(t.perm, info)); err != nil {
+			return err
+		}
+		if err := c.PosixRename(part, remoteFile); err != nil {
+			// servers without the posix-rename extension do not replace
+			c.Remove(remoteFile)
+			return c.Rename(part, remoteFile)
+		}
+		return nil
+	})
+	return wrap("write", remoteFile, err)
+}
+
+func (t *sftpTransfer) Download(ctx context.Context, remoteFile, localFile string) error {
+	err := t.session(ctx, func(c *sftp.Client) error {
+		in, err := c.Open(remoteFile)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		out, err := os.Create(localFile)
+		if err != nil {
+			return err
+		}
+		var size int64
+		if info, err := in.Stat(); err == nil {
+			size = info.Size()
+		}
+		if _, err := io.Copy(progress.Writer(ctx, out, "download "+remoteFile, size), in); err != nil {
+			out.Close()
+			return err
+		}
+		return out.Close()
+	})
+	return wrap("read", remoteFile, err)
+}
+
+func (t *sftpTransfer) Stat(ctx context.Context, remoteFile string) (os.FileInfo, error) {
+	var info os.FileInfo
+	err := t.session(ctx, func(c *sftp.Client) error {
+		var err error
+		info, err = c.Stat(remoteFile)
+		return err
+	})
+	return info, wrap("stat", remoteFile, err)
+}
+
+func (t *sftpTransfer) Remove(ctx context.Context, remoteFile string) error {
+	err := t.session(ctx, func(c *sftp.Client) error {
+		return c.Remove(remoteFile)
+	})
+	return wrap("remove", remoteFile, err)
+}
+
+func (t *sftpTransfer) Mkdir(ctx context.Context, remoteDir string) error {
+	err := t.session(ctx, func(c *sftp.Client) error {
+		return c.MkdirAll(remoteDir)
+	})
+	return wrap("mkdir", remoteDir, err)
+}
+
+// Checksum runs sha256sum on the host and, where commands cannot be run
+// (e.g. sftp only accounts), hashes the file read over sftp.
+func (t *sftpTransfer) Checksum(ctx context.Context, remoteFile string) (string, error) {
+	if sum, err := remoteSHA256(ctx, t.client, remoteFile); err == nil || ctx.Err() != nil {
+		return sum, wrap("checksum", remoteFile, err)
+	}
+	var sum string
+	err := t.session(ctx, func(c *sftp.Client) error {
+		in, err := c.Open(remoteFile)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		sum, err = digest(in)
+		return err
+	})
+	return sum, wrap("checksum", remoteFile, err)
+}
+
+// upload wraps the rest of the local file in for progress reports.
+func upload(ctx context.Context, in *os.File, remoteFile string) io.Reader {
+	var size int64
+	if info, err := in.Stat(); err == nil {
+		offset, _ := in.Seek(0, io.SeekCurrent)
+		size = info.Size() - offset
+	}
+	return progress.Reader(ctx, in, "upload "+remoteFile, size)
+}
+
+// filePerm is perm, or the permissions of the local file info when it is 0.
+func filePerm(perm os.FileMode, info os.FileInfo) os.FileMode {
+	if perm == 0 {
+		return info.Mode().Perm()
+	}
+	return perm
+}
+
+func wrap(op, path string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &TransferError{Op: op, Path: path, Err: err}
+}
@@ -0,0 +1,177 @@
+package transfer
+
+import (
+	"../scp"
+	"../sshConnection"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// Transfer protocols, Auto uses sftp and falls back to scp on hosts without
+// the sftp subsystem.
+const (
+	Auto = "auto"
+	SCP  = "scp"
+	SFTP = "sftp"
+)
+
+// ErrTransfer matches every failed transfer, of both protocols.
+var ErrTransfer = scp.ErrTransfer
+
+// ErrUnsupported is returned when the host does not offer the protocol.
+var ErrUnsupported = errors.New("protocol not supported by the host")
+
+// Transferer moves files between the local and the remote host. Remote paths
+// are absolute, Mkdir creates missing parents. Checksum gives the hex encoded
+// SHA-256 digest of a remote file. ResumeUpload uploads through remoteFile
+// with PartSuffix and continues a partial file left there by an interrupted
+// attempt. UploadDir and DownloadDir copy a directory with its files and
+// subdirectories, keeping modes and modification times; the parent of the
+// destination has to exist, an existing destination is merged into.
+type Transferer interface {
+	Upload(ctx context.Context, localFile, remoteFile string) error
+	ResumeUpload(ctx context.Context, localFile, remoteFile string) error
+	Download(ctx context.Context, remoteFile, localFile string) error
+	UploadDir(ctx context.Context, localDir, remoteDir string) error
+	DownloadDir(ctx context.Context, remoteDir, localDir string) error
+	Stat(ctx context.Context, remoteFile string) (os.FileInfo, error)
+	Remove(ctx context.Context, remoteFile string) error
+	Mkdir(ctx context.Context, remoteDir string) error
+	Checksum(ctx context.Context, remoteFile string) (string, error)
+}
+
+// TransferError is a failed sftp operation, scp reports *scp.TransferError.
+type TransferError struct {
+	Op   string
+	Path string
+	Err  error
+}
+
+func (e *TransferError) Error() string {
+	return "sftp " + e.Op + " " + e.Path + ": " + e.Err.Error()
+}
+
+func (e *TransferError) Unwrap() error {
+	return e.Err
+}
+
+func (e *TransferError) Is(target error) bool {
+	return target == ErrTransfer
+}
+
+// New returns the Transferer of the protocol over the client connection.
+// Uploaded files get the permissions perm, 0 keeps those of the local files.
+func New(protocol string, client *sshConnection.Client, perm os.FileMode) (Transferer, error) {
+	switch protocol {
+	case SCP:
+		return &scpTransfer{client: client, perm: perm}, nil
+	case SFTP:
+		return &sftpTransfer{client: client, perm: perm}, nil
+	case Auto, "":
+		return &autoTransfer{client: client, perm: perm}, nil
+	}
+	return nil, fmt.Errorf("unknown transfer protocol %q", protocol)
+}
+
+// autoTransfer asks the host for sftp once and sticks to the answer.
+type autoTransfer struct {
+	client *sshConnection.Client
+	perm   os.FileMode
+	mu     sync.Mutex
+	chosen Transferer
+}
+
+func (t *autoTransfer) pick(ctx context.Context) (Transferer, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.chosen != nil {
+		return t.chosen, nil
+	}
+	sftp := &sftpTransfer{client: t.client, perm: t.perm}
+	err := sftp.probe(ctx)
+	switch {
+	case err == nil:
+		t.chosen = sftp
+	case errors.Is(err, ErrUnsupported):
+		fmt.Println("No sftp on " + t.client.Host + ", using scp")
+		t.chosen = &scpTransfer{client: t.client, perm: t.perm}
+	default:
+		return nil, err
+	}
+	return t.chosen, nil
+}
+
+func (t *autoTransfer) Upload(ctx context.Context, localFile, remoteFile string) error {
+	chosen, err := t.pick(ctx)
+	if err != nil {
+		return err
+	}
+	return chosen.Upload(ctx, localFile, remoteFile)
+}
+
+func (t *autoTransfer) ResumeUpload(ctx context.Context, localFile, remoteFile string) error {
+	chosen, err := t.pick(ctx)
+	if err != nil {
+		return err
+	}
+	return chosen.ResumeUpload(ctx, localFile, remoteFile)
+}
+
+func (t *autoTransfer) Download(ctx context.Context, remoteFile, localFile string) error {
+	chosen, err := t.pick(ctx)
+	if err != nil {
+		return err
+	}
+	return chosen.Download(ctx, remoteFile, localFile)
+}
+
+func (t *autoTransfer) UploadDir(ctx context.Context, localDir, remoteDir string) error {
+	chosen, err := t.pick(ctx)
+	if err != nil {
+		return err
+	}
+	return chosen.UploadDir(ctx, localDir, remoteDir)
+}
+
+func (t *autoTransfer) DownloadDir(ctx context.Context, remoteDir, localDir string) error {
+	chosen, err := t.pick(ctx)
+	if err != nil {
+		return err
+	}
+	return chosen.DownloadDir(ctx, remoteDir, localDir)
+}
+
+func (t *autoTransfer) Stat(ctx context.Context, remoteFile string) (os.FileInfo, error) {
+	chosen, err := t.pick(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return chosen.Stat(ctx, remoteFile)
+}
+
+func (t *autoTransfer) Remove(ctx context.Context, remoteFile string) error {
+	chosen, err := t.pick(ctx)
+	if err != nil {
+		return err
+	}
+	return chosen.Remove(ctx, remoteFile)
+}
+
+func (t *autoTransfer) Mkdir(ctx context.Context, remoteDir string) error {
+	chosen, err := t.pick(ctx)
+	if err != nil {
+		return err
+	}
+	return chosen.Mkdir(ctx, remoteDir)
+}
+
+func (t *autoTransfer) Checksum(ctx context.Context, remoteFile string) (string, error) {
+	chosen, err := t.pick(ctx)
+	if err != nil {
+		return "", err
+	}
+	return chosen.Checksum(ctx, remoteFile)
+}